@@ -2,18 +2,175 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"io"
 	"io/ioutil"
+	"mime"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 
+	validation "github.com/go-ozzo/ozzo-validation/v4"
+	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/m-mizutani/goerr"
+	"golang.org/x/net/http2"
 )
 
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
 
+// defaultHTTPClient creates HTTP client of a query if no client is given by option. It's a variable for tests to inspect the client built from command line options.
+var defaultHTTPClient = newHTTPClient
+
+func newHTTPClient(cfg *queryConfig) *http.Client {
+	client := &http.Client{}
+	if cfg.NoFollowRedirects {
+		client.CheckRedirect = rejectRedirect
+	}
+
+	if cfg.HTTP2 {
+		client.Transport = newHTTP2Transport(cfg)
+		return client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.MaxIdleConns > 0 {
+		transport.MaxIdleConnsPerHost = cfg.MaxIdleConns
+	}
+	if cfg.IdleTimeout > 0 {
+		transport.IdleConnTimeout = cfg.IdleTimeout
+	}
+	client.Transport = transport
+
+	return client
+}
+
+// rejectRedirect makes http.Client return 3xx response as it is, then it's handled as unexpected status. Redirect is not followed to avoid sending custom headers to unexpected host.
+func rejectRedirect(req *http.Request, via []*http.Request) error {
+	logger.With("from", via[len(via)-1].URL.String()).
+		With("location", req.URL.String()).
+		Warn("server returned redirect, but it's not followed by --no-follow-redirects")
+	return http.ErrUseLastResponse
+}
+
+func newQueryRequest(ctx context.Context, input *QueryInput) (*http.Request, error) {
+	reqURL, err := url.Parse(input.URL)
+	if err != nil {
+		return nil, ErrInvalidInput.Wrap(err).With("input", input)
+	}
+	query := reqURL.Query()
+	if input.Metrics {
+		query.Set("metrics", "true")
+	}
+	if input.Pretty {
+		query.Set("pretty", "true")
+	}
+	reqURL.RawQuery = query.Encode()
+
+	if input.NDJSON {
+		return newNDJSONRequest(ctx, reqURL, input)
+	}
+
+	if input.Method == http.MethodGet {
+		data, err := json.Marshal(input.Data)
+		if err != nil {
+			return nil, goerr.Wrap(err).With("input", input)
+		}
+
+		if encoded := url.QueryEscape(string(data)); len(encoded) <= input.MaxQueryLength {
+			getURL := *reqURL
+			query.Set("input", string(data))
+			getURL.RawQuery = query.Encode()
+
+			httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, getURL.String(), nil)
+			if err != nil {
+				return nil, ErrInvalidInput.Wrap(err).With("input", input)
+			}
+			return httpReq, nil
+		}
+
+		logger.With("max", input.MaxQueryLength).Debug("input is too large for query parameter, fall back to POST")
+	}
+
+	// v0 API accepts input document as it is
+	var body interface{} = &opaRequest{Input: input.Data}
+	if input.APIVersion == APIVersionV0 {
+		body = input.Data
+	}
+
+	inputData, err := json.Marshal(body)
+	if err != nil {
+		return nil, goerr.Wrap(err).With("input", input)
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL.String(), bytes.NewReader(inputData))
+	if err != nil {
+		return nil, ErrInvalidInput.Wrap(err).With("input", input)
+	}
+	return httpReq, nil
+}
+
+func newNDJSONRequest(ctx context.Context, reqURL *url.URL, input *QueryInput) (*http.Request, error) {
+	docs, ok := input.Data.([]interface{})
+	if !ok {
+		return nil, goerr.Wrap(ErrInvalidInput, "data must be list of documents for NDJSON").With("input", input)
+	}
+
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, doc := range docs {
+		// Encode appends a newline to each line
+		if err := encoder.Encode(&opaRequest{Input: doc}); err != nil {
+			return nil, goerr.Wrap(err).With("input", input)
+		}
+	}
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, reqURL.String(), &body)
+	if err != nil {
+		return nil, ErrInvalidInput.Wrap(err).With("input", input)
+	}
+	return httpReq, nil
+}
+
+// http2RoundTripper always speaks HTTP/2. HTTP/2 over TLS is used for https URL and h2c (HTTP/2 cleartext) is used for http URL. The scheme is decided per request because query URL may be changed by --discover.
+type http2RoundTripper struct {
+	tls *http2.Transport
+	h2c *http2.Transport
+}
+
+func (x *http2RoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "http" {
+		return x.h2c.RoundTrip(req)
+	}
+	return x.tls.RoundTrip(req)
+}
+
+// newHTTP2Transport creates a transport for --http2. --idle-timeout is applied to both of TLS and h2c connections.
+func newHTTP2Transport(cfg *queryConfig) *http2RoundTripper {
+	return &http2RoundTripper{
+		tls: &http2.Transport{
+			IdleConnTimeout: cfg.IdleTimeout,
+		},
+		h2c: &http2.Transport{
+			AllowHTTP:       true,
+			IdleConnTimeout: cfg.IdleTimeout,
+			// connect without TLS, and dial is canceled with the request
+			DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+}
+
 type Client struct {
 	httpClient HTTPClient
 }
@@ -23,61 +180,303 @@ type opaRequest struct {
 }
 
 type opaResponse struct {
-	Result interface{} `json:"result"`
+	Result  json.RawMessage `json:"result"`
+	Metrics QueryMetrics    `json:"metrics"`
 }
 
+// QueryMetrics is server-side evaluation metrics (e.g. timer_rego_query_eval_ns) returned by OPA server if QueryInput.Metrics is true.
+type QueryMetrics map[string]interface{}
+
 type QueryInput struct {
 	Data    interface{}
 	URL     string
 	Headers http.Header
+
+	// Method is http.MethodPost (default) or http.MethodGet. Input is sent as query parameter with GET method, but POST is used if length of the encoded parameter exceeds MaxQueryLength.
+	Method         string
+	MaxQueryLength int
+
+	// Metrics and Pretty add metrics=true and pretty=true query parameters
+	Metrics bool
+	Pretty  bool
+
+	// SignKey is a key of HMAC-SHA256 signature of request body. Hex encoded signature is set to SignHeader if SignKey is not empty.
+	SignKey    []byte `zlog:"secret"`
+	SignHeader string
+
+	// APIVersion is APIVersionV1 (default) or APIVersionV0. Input and result are not wrapped with {"input": ...} and {"result": ...} in v0 API.
+	APIVersion string
+
+	// NDJSON sends each element of Data ([]interface{}) as a line of application/x-ndjson in a single POST request. Server must respond a line of result for each input in application/x-ndjson, and the results are decoded to out as a list.
+	NDJSON bool
 }
 
-func (x *Client) Query(ctx context.Context, input *QueryInput, out interface{}) error {
-	logger.With("input", input).Debug("sending query")
+const (
+	APIVersionV0 = "v0"
+	APIVersionV1 = "v1"
 
-	inputData, err := json.Marshal(&opaRequest{Input: input.Data})
-	if err != nil {
-		return goerr.Wrap(err).With("input", input)
-	}
+	contentTypeNDJSON = "application/x-ndjson"
+)
+
+func (x *Client) Query(ctx context.Context, input *QueryInput, out interface{}) (QueryMetrics, error) {
+	logger.With("input", input).Debug("sending query")
 
-	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, input.URL, bytes.NewReader(inputData))
+	httpReq, err := newQueryRequest(ctx, input)
 	if err != nil {
-		return ErrInvalidInput.Wrap(err).With("input", input)
+		return nil, err
 	}
 
 	httpReq.Header = input.Headers
-	httpReq.Header.Add("Content-Type", "application/json")
+	setHostHeader(httpReq)
+	if httpReq.Method == http.MethodPost && httpReq.Header.Get("Content-Type") == "" {
+		if input.NDJSON {
+			httpReq.Header.Set("Content-Type", contentTypeNDJSON)
+		} else {
+			httpReq.Header.Set("Content-Type", "application/json")
+		}
+	}
+	if httpReq.Header.Get("Accept-Encoding") == "" {
+		httpReq.Header.Set("Accept-Encoding", "gzip")
+	}
+	if len(input.SignKey) > 0 {
+		if err := signRequest(httpReq, input.SignKey, input.SignHeader); err != nil {
+			return nil, err
+		}
+	}
 
 	httpResp, err := x.httpClient.Do(httpReq)
 	if err != nil {
-		return ErrRequestFailed.Wrap(err)
+		return nil, ErrRequestFailed.Wrap(ErrConnectionFailed.Wrap(err))
 	}
 
 	defer httpResp.Body.Close()
 	if httpResp.StatusCode != http.StatusOK {
-		body, _ := ioutil.ReadAll(httpResp.Body)
-		return goerr.Wrap(ErrRequestFailed, "status code is not OK").
+		body, _ := readBody(httpResp)
+
+		// v0 API responds 404 for undefined document instead of omitting result field
+		if input.APIVersion == APIVersionV0 && isUndefinedDocument(httpResp.StatusCode, body) {
+			return nil, decodeJSON([]byte("null"), out)
+		}
+
+		return nil, ErrRequestFailed.Wrap(ErrUnexpectedStatus).
 			With("code", httpResp.StatusCode).
 			With("body", string(body))
 	}
 
-	raw, err := ioutil.ReadAll(httpResp.Body)
+	raw, err := readBody(httpResp)
 	if err != nil {
-		return ErrUnexpectedResp.Wrap(err).With("body", string(raw))
+		return nil, err
+	}
+
+	if input.NDJSON {
+		return nil, decodeNDJSONResponse(httpResp, raw, len(input.Data.([]interface{})), out)
+	}
+
+	// v0 API responds result document as it is
+	if input.APIVersion == APIVersionV0 {
+		if err := decodeJSON(raw, out); err != nil {
+			return nil, ErrUnexpectedResp.Wrap(ErrMalformedResp.Wrap(err)).With("body", string(raw))
+		}
+		return nil, nil
 	}
 
 	var opaResp opaResponse
 	if err := json.Unmarshal(raw, &opaResp); err != nil {
-		return ErrUnexpectedResp.Wrap(err).With("body", string(raw))
+		return nil, ErrUnexpectedResp.Wrap(ErrMalformedResp.Wrap(err)).With("body", string(raw))
+	}
+
+	// result field is omitted if the document is undefined
+	result := opaResp.Result
+	if len(result) == 0 {
+		result = json.RawMessage("null")
+	}
+	if err := decodeJSON(result, out); err != nil {
+		return nil, ErrUnexpectedResp.Wrap(ErrMalformedResp.Wrap(err)).With("result data", string(raw))
+	}
+
+	return opaResp.Metrics, nil
+}
+
+// decodeNDJSONResponse decodes lines of {"result": ...} to out as a list of results. Content-Type of the response is checked to detect a server not supporting NDJSON.
+func decodeNDJSONResponse(httpResp *http.Response, raw []byte, count int, out interface{}) error {
+	if mediaType, _, _ := mime.ParseMediaType(httpResp.Header.Get("Content-Type")); mediaType != contentTypeNDJSON {
+		return goerr.Wrap(ErrUnexpectedResp, "server does not support NDJSON").
+			With("content-type", httpResp.Header.Get("Content-Type")).
+			With("body", string(raw))
+	}
+
+	results := []json.RawMessage{}
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	for {
+		var opaResp opaResponse
+		if err := decoder.Decode(&opaResp); err == io.EOF {
+			break
+		} else if err != nil {
+			return ErrUnexpectedResp.Wrap(ErrMalformedResp.Wrap(err)).With("body", string(raw))
+		}
+
+		// result field is omitted if the document is undefined
+		result := opaResp.Result
+		if len(result) == 0 {
+			result = json.RawMessage("null")
+		}
+		results = append(results, result)
 	}
 
-	result, err := json.Marshal(opaResp.Result)
+	if len(results) != count {
+		return goerr.Wrap(ErrUnexpectedResp, "number of results does not match with input documents").
+			With("input", count).
+			With("results", len(results))
+	}
+
+	list, err := json.Marshal(results)
 	if err != nil {
-		return ErrUnexpectedResp.Wrap(err).With("opaResp", opaResp)
+		return goerr.Wrap(err)
 	}
-	if err := json.Unmarshal(result, out); err != nil {
-		return ErrUnexpectedResp.Wrap(err).With("result data", string(raw))
+	if err := decodeJSON(list, out); err != nil {
+		return ErrUnexpectedResp.Wrap(ErrMalformedResp.Wrap(err)).With("body", string(raw))
+	}
+	return nil
+}
+
+// signRequest sets hex encoded HMAC-SHA256 of request body to the header. Body of GET request is empty.
+func signRequest(httpReq *http.Request, key []byte, header string) error {
+	var body []byte
+	if httpReq.GetBody != nil {
+		r, err := httpReq.GetBody()
+		if err != nil {
+			return goerr.Wrap(err)
+		}
+		if body, err = ioutil.ReadAll(r); err != nil {
+			return goerr.Wrap(err)
+		}
 	}
 
+	mac := hmac.New(sha256.New, key)
+	if _, err := mac.Write(body); err != nil {
+		return goerr.Wrap(err)
+	}
+	httpReq.Header.Set(header, hex.EncodeToString(mac.Sum(nil)))
 	return nil
 }
+
+// setHostHeader applies Host header allowed by --allow-protected-headers to httpReq.Host because net/http ignores Host in header of client request.
+func setHostHeader(httpReq *http.Request) {
+	if host := httpReq.Header.Get("Host"); host != "" {
+		httpReq.Host = host
+	}
+}
+
+func isUndefinedDocument(code int, body []byte) bool {
+	if code != http.StatusNotFound {
+		return false
+	}
+
+	var resp struct {
+		Code string `json:"code"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return false
+	}
+	return resp.Code == "undefined_document"
+}
+
+// decodeJSON unmarshals data with json.Number to keep precision of large integer.
+func decodeJSON(data []byte, out interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(out)
+}
+
+// readBody reads response body and decompresses it if gzip encoded. Broken gzip stream is reported as ErrMalformedResp and read errors of the body itself (e.g. connection reset during transfer) as ErrConnectionFailed.
+func readBody(resp *http.Response) ([]byte, error) {
+	body := &bodyReader{r: resp.Body}
+	var r io.Reader = body
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		gz, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, body.readError(err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return raw, body.readError(err).With("body", string(raw))
+	}
+	return raw, nil
+}
+
+// bodyReader remembers read error of response body to distinguish it from error of gzip decompression.
+type bodyReader struct {
+	r   io.Reader
+	err error
+}
+
+func (x *bodyReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	if err != nil && err != io.EOF {
+		x.err = err
+	}
+	return n, err
+}
+
+func (x *bodyReader) readError(err error) *goerr.Error {
+	if x.err != nil {
+		return ErrRequestFailed.Wrap(ErrConnectionFailed.Wrap(err))
+	}
+	return ErrUnexpectedResp.Wrap(ErrMalformedResp.Wrap(err))
+}
+
+type discoveryResponse struct {
+	URL string `json:"url"`
+}
+
+// Discover fetches a discovery document from discoverURL and returns query URL of OPA server in the document. The discovery document must be JSON object such as {"url": "https://opa.example.com/v1/data/foo"}.
+func (x *Client) Discover(ctx context.Context, discoverURL string, headers http.Header) (string, error) {
+	logger.With("url", discoverURL).Debug("discovering query URL")
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, discoverURL, nil)
+	if err != nil {
+		return "", ErrInvalidInput.Wrap(err).With("url", discoverURL)
+	}
+	httpReq.Header = headers.Clone()
+	setHostHeader(httpReq)
+	if httpReq.Header.Get("Accept-Encoding") == "" {
+		httpReq.Header.Set("Accept-Encoding", "gzip")
+	}
+
+	httpResp, err := x.httpClient.Do(httpReq)
+	if err != nil {
+		return "", ErrRequestFailed.Wrap(ErrConnectionFailed.Wrap(err)).With("url", discoverURL)
+	}
+
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		body, _ := readBody(httpResp)
+		return "", ErrRequestFailed.Wrap(ErrUnexpectedStatus).
+			With("url", discoverURL).
+			With("code", httpResp.StatusCode).
+			With("body", string(body))
+	}
+
+	raw, err := readBody(httpResp)
+	if err != nil {
+		return "", err
+	}
+
+	var resp discoveryResponse
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return "", ErrUnexpectedResp.Wrap(ErrMalformedResp.Wrap(err)).With("body", string(raw))
+	}
+
+	if err := validation.Validate(resp.URL,
+		validation.Required,
+		is.URL,
+	); err != nil {
+		return "", ErrUnexpectedResp.Wrap(err).With("body", string(raw))
+	}
+
+	return resp.URL, nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/m-mizutani/goerr"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v2"
+)
+
+// configFile is a schema of --config file. JSON is also acceptable because it's a subset of YAML.
+type configFile struct {
+	URL           *string  `yaml:"url"`
+	Discover      *string  `yaml:"discover"`
+	Format        *string  `yaml:"format"`
+	Headers       []string `yaml:"http-header"`
+	MetaData      []string `yaml:"metadata"`
+	MetaDataField *string  `yaml:"metadata-field"`
+	DataField     *string  `yaml:"data-field"`
+	FailDefined   *bool    `yaml:"fail-defined"`
+	FailUndefined *bool    `yaml:"fail-undefined"`
+	LogLevel      *string  `yaml:"log-level"`
+}
+
+func loadConfigFile(path string) (*configFile, error) {
+	raw, err := ioutil.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, goerr.Wrap(err).With("path", path)
+	}
+
+	var file configFile
+	if err := yaml.UnmarshalStrict(raw, &file); err != nil {
+		return nil, ErrInvalidConfiguration.Wrap(err).With("path", path)
+	}
+
+	return &file, nil
+}
+
+// loadEnvConfig reads config in the same schema as config file from an environment variable, e.g. for serverless platform passing all config in one variable.
+func loadEnvConfig(name string) (*configFile, error) {
+	raw, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, goerr.Wrap(ErrInvalidConfiguration, "environment variable for config is not set").
+			With("env", name).
+			With("target", "--env-config")
+	}
+
+	var file configFile
+	if err := yaml.UnmarshalStrict([]byte(raw), &file); err != nil {
+		return nil, ErrInvalidConfiguration.Wrap(err).With("env", name).With("target", "--env-config")
+	}
+
+	return &file, nil
+}
+
+// apply overwrites cfg with values of the config file. Values set by command line option or environment variable have priority over the config file.
+func (x *configFile) apply(c *cli.Context, cfg *config) {
+	isSet := func(names ...string) bool {
+		for _, name := range names {
+			if c.IsSet(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	setString := func(dst *string, src *string, names ...string) {
+		if src != nil && !isSet(names...) {
+			*dst = *src
+		}
+	}
+	setBool := func(dst *bool, src *bool, names ...string) {
+		if src != nil && !isSet(names...) {
+			*dst = *src
+		}
+	}
+
+	setString(&cfg.URL, x.URL, "url", "u")
+	setString(&cfg.Discover, x.Discover, "discover")
+	setString(&cfg.Format, x.Format, "format", "f")
+	setString(&cfg.MetaDataField, x.MetaDataField, "metadata-field")
+	setString(&cfg.DataField, x.DataField, "data-field")
+	setString(&cfg.LogLevel, x.LogLevel, "log-level", "l")
+	setBool(&cfg.FailDefined, x.FailDefined, "fail-defined", "fail-non-empty")
+	setBool(&cfg.FailUndefined, x.FailUndefined, "fail-undefined", "fail-empty")
+
+	if x.Headers != nil && !isSet("http-header", "H") {
+		cfg.Headers = x.Headers
+	}
+	if x.MetaData != nil && !isSet("metadata", "m") {
+		cfg.MetaData = x.MetaData
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const diffContext = 3
+
+type diffOp struct {
+	kind byte // ' ', '-' or '+'
+	line string
+}
+
+// unifiedDiff returns difference between a and b in unified format. It returns empty string if a and b are same.
+func unifiedDiff(aName, bName, a, b string) string {
+	// trailing newline would be an extra empty line in hunks
+	ops := diffLines(
+		strings.Split(strings.TrimSuffix(a, "\n"), "\n"),
+		strings.Split(strings.TrimSuffix(b, "\n"), "\n"),
+	)
+
+	changed := false
+	for _, op := range ops {
+		if op.kind != ' ' {
+			changed = true
+			break
+		}
+	}
+	if !changed {
+		return ""
+	}
+
+	var w strings.Builder
+	fmt.Fprintf(&w, "--- %s\n+++ %s\n", aName, bName)
+
+	// aLine and bLine are 1-origin line numbers of ops[i]
+	aLine, bLine := 1, 1
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			aLine++
+			bLine++
+			i++
+			continue
+		}
+
+		// expand hunk to include leading context and following changes within context
+		start := i - diffContext
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(ops); j++ {
+			if ops[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= diffContext*2 {
+				break
+			}
+		}
+		end += diffContext
+		if end > len(ops) {
+			end = len(ops)
+		}
+
+		aStart, bStart := aLine-(i-start), bLine-(i-start)
+		var aLen, bLen int
+		for _, op := range ops[start:end] {
+			if op.kind != '+' {
+				aLen++
+			}
+			if op.kind != '-' {
+				bLen++
+			}
+		}
+		fmt.Fprintf(&w, "@@ -%d,%d +%d,%d @@\n", aStart, aLen, bStart, bLen)
+		for _, op := range ops[start:end] {
+			fmt.Fprintf(&w, "%c%s\n", op.kind, op.line)
+		}
+
+		aLine, bLine = aStart+aLen, bStart+bLen
+		i = end
+	}
+
+	return w.String()
+}
+
+// diffLines computes shortest edit script from a to b by Myers' algorithm. Linear space refinement (divide and conquer by middle snake) is used not to allocate a table of len(a)*len(b) for large documents.
+func diffLines(a, b []string) []diffOp {
+	ops := appendDiff(nil, a, b)
+
+	// put deletions before insertions in each run of changes as diff tools do
+	for i := 0; i < len(ops); {
+		if ops[i].kind == ' ' {
+			i++
+			continue
+		}
+		j := i
+		for j < len(ops) && ops[j].kind != ' ' {
+			j++
+		}
+		sort.SliceStable(ops[i:j], func(p, q int) bool {
+			return ops[i+p].kind == '-' && ops[i+q].kind == '+'
+		})
+		i = j
+	}
+	return ops
+}
+
+func appendDiff(ops []diffOp, a, b []string) []diffOp {
+	var prefix, suffix int
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	for _, line := range a[:prefix] {
+		ops = append(ops, diffOp{kind: ' ', line: line})
+	}
+
+	ma, mb := a[prefix:len(a)-suffix], b[prefix:len(b)-suffix]
+	switch {
+	case len(ma) == 0:
+		for _, line := range mb {
+			ops = append(ops, diffOp{kind: '+', line: line})
+		}
+	case len(mb) == 0:
+		for _, line := range ma {
+			ops = append(ops, diffOp{kind: '-', line: line})
+		}
+	default:
+		x, y, u, v := middleSnake(ma, mb)
+		ops = appendDiff(ops, ma[:x], mb[:y])
+		for _, line := range ma[x:u] {
+			ops = append(ops, diffOp{kind: ' ', line: line})
+		}
+		ops = appendDiff(ops, ma[u:], mb[v:])
+	}
+
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, diffOp{kind: ' ', line: line})
+	}
+	return ops
+}
+
+// middleSnake finds a snake (diagonal of equal lines) from (x, y) to (u, v) in the middle of a shortest edit script by searching from both ends. a and b must not be empty and must differ in their first and last lines.
+func middleSnake(a, b []string) (x, y, u, v int) {
+	n, m := len(a), len(b)
+	max := (n + m + 1) / 2
+	delta := n - m
+	odd := delta%2 != 0
+
+	// furthest x of forward and backward (in reversed coordinates) paths for each diagonal k = x - y
+	offset := max + 1
+	forward := make([]int, 2*max+3)
+	backward := make([]int, 2*max+3)
+
+	for d := 0; d <= max; d++ {
+		for k := -d; k <= d; k += 2 {
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y = x - k
+			u, v = x, y
+			for u < n && v < m && a[u] == b[v] {
+				u++
+				v++
+			}
+			forward[offset+k] = u
+
+			// diagonal k corresponds to delta-k in reversed coordinates
+			if kr := delta - k; odd && kr >= -(d-1) && kr <= d-1 && u+backward[offset+kr] >= n {
+				return x, y, u, v
+			}
+		}
+
+		for k := -d; k <= d; k += 2 {
+			var bx int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				bx = backward[offset+k+1]
+			} else {
+				bx = backward[offset+k-1] + 1
+			}
+			by := bx - k
+			ex, ey := bx, by
+			for ex < n && ey < m && a[n-1-ex] == b[m-1-ey] {
+				ex++
+				ey++
+			}
+			backward[offset+k] = ex
+
+			if kf := delta - k; !odd && kf >= -d && kf <= d && ex+forward[offset+kf] >= n {
+				return n - ex, m - ey, n - bx, m - by
+			}
+		}
+	}
+
+	// never reached because paths from both ends always overlap within max steps
+	return 0, 0, n, m
+}
@@ -8,6 +8,11 @@ var (
 	ErrRequestFailed        = goerr.New("request to OPA server failed")
 	ErrUnexpectedResp       = goerr.New("unexpected response from OPA server")
 
+	// Details of HTTP layer errors, wrapped by ErrRequestFailed or ErrUnexpectedResp
+	ErrConnectionFailed = goerr.New("connection failed")
+	ErrUnexpectedStatus = goerr.New("unexpected status code") // status code is set to "code" value
+	ErrMalformedResp    = goerr.New("malformed response body")
+
 	// just to control exit code
 	ErrExitWithNonZero = goerr.New("exit with non-zero")
 )
@@ -1,6 +1,11 @@
 package main
 
-import "io"
+import (
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
 
 // nolint
 func WithHTTPClient(client HTTPClient) Option {
@@ -15,3 +20,37 @@ func WithStdin(stdin io.Reader) Option {
 		proc.stdin = stdin
 	}
 }
+
+// nolint
+func WithStdout(stdout io.Writer) Option {
+	return func(proc *Proc) {
+		proc.stdout = stdout
+	}
+}
+
+// nolint
+func NewHTTPClient(maxIdleConns int, idleTimeout time.Duration) *http.Client {
+	return newHTTPClient(&queryConfig{
+		MaxIdleConns: maxIdleConns,
+		IdleTimeout:  idleTimeout,
+	})
+}
+
+// nolint
+func CaptureHTTPClient(t *testing.T) func() *http.Client {
+	var captured *http.Client
+	orig := defaultHTTPClient
+	defaultHTTPClient = func(cfg *queryConfig) *http.Client {
+		captured = orig(cfg)
+		return captured
+	}
+	t.Cleanup(func() { defaultHTTPClient = orig })
+	return func() *http.Client { return captured }
+}
+
+// nolint
+func WithStderr(stderr io.Writer) Option {
+	return func(proc *Proc) {
+		proc.stderr = stderr
+	}
+}
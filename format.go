@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	formatAuto = "auto"
+	formatJSON = "json"
+	formatYAML = "yaml"
+	formatTOML = "toml"
+	formatCSV  = "csv"
+
+	// size of head of input to sniff format
+	sniffSize = 4096
+)
+
+// decoder decodes input into documents. Each document is sent to OPA server as input, or all documents are sent as an array if there are multiple. Documents must be marshalable by encoding/json, e.g. map[string]interface{} instead of map[interface{}]interface{}.
+type decoder func(r io.Reader) ([]interface{}, error)
+
+// decoders are input formats available by --format except auto and csv, which need extra handling
+var decoders = map[string]decoder{
+	formatJSON: decodeJSONDocuments,
+	formatYAML: decodeYAMLDocuments,
+	formatTOML: decodeTOMLDocuments,
+}
+
+// inputFormats returns sorted names of all formats accepted by --format.
+func inputFormats() []string {
+	formats := []string{formatAuto, formatCSV}
+	for format := range decoders {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+var (
+	tomlKeyValue = regexp.MustCompile(`^[A-Za-z0-9_\-."]+\s*=`)
+	tomlTable    = regexp.MustCompile(`^\[\[?[A-Za-z_][A-Za-z0-9_\-."]*\]\]?\s*$`)
+)
+
+// formatByExt returns format of a file by the extension. It returns empty string if the extension is unknown.
+func formatByExt(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	case ".toml":
+		return formatTOML
+	case ".csv":
+		return formatCSV
+	}
+	return ""
+}
+
+// detectFormat decides format of input by extension of path, and by content if path is stdin or the extension is unknown. Returned reader must be used instead of r because head of r is consumed for sniffing.
+func detectFormat(path string, r io.Reader) (string, io.Reader) {
+	if path != "-" {
+		if format := formatByExt(path); format != "" {
+			return format, r
+		}
+	}
+
+	br := bufio.NewReaderSize(r, sniffSize)
+	// error is ignored because Peek returns available bytes even if input is shorter than sniffSize
+	head, _ := br.Peek(sniffSize)
+	return sniffFormat(head), br
+}
+
+// sniffFormat guesses format from head of input. JSON is chosen for empty input and YAML is chosen if it's neither TOML nor JSON. CSV is not sniffed because a single line of YAML can also be valid CSV.
+func sniffFormat(head []byte) string {
+	for offset := 0; offset < len(head); {
+		line := head[offset:]
+		next := len(head)
+		if i := bytes.IndexByte(line, '\n'); i >= 0 {
+			line, next = line[:i], offset+i+1
+		}
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			offset = next
+			continue
+		}
+
+		switch {
+		case tomlKeyValue.Match(line), tomlTable.Match(line):
+			return formatTOML
+		case line[0] == '{', line[0] == '[':
+			return formatJSON
+		// a top-level scalar (e.g. 12345678901234567890123) is also valid YAML, but YAML decoder loses precision of large numbers
+		case isJSONValues(head[offset:]):
+			return formatJSON
+		default:
+			return formatYAML
+		}
+	}
+
+	return formatJSON
+}
+
+// isJSONValues returns true if head consists of JSON values. The last value may be truncated because head is a part of input.
+func isJSONValues(head []byte) bool {
+	decoder := json.NewDecoder(bytes.NewReader(head))
+	for {
+		var v json.RawMessage
+		err := decoder.Decode(&v)
+		switch {
+		case err == io.EOF:
+			return true
+		case err == io.ErrUnexpectedEOF:
+			return len(head) >= sniffSize
+		case err != nil:
+			return false
+		}
+	}
+}
+
+// decodeCSV converts CSV rows to a list of objects. Keys of the objects are columns of the header row, or positional index ("0", "1", ...) if noHeader is true. All values are string.
+func decodeCSV(r io.Reader, noHeader bool) ([]interface{}, error) {
+	records, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []interface{}{}
+	if len(records) == 0 {
+		return rows, nil
+	}
+
+	var header []string
+	if noHeader {
+		for i := range records[0] {
+			header = append(header, strconv.Itoa(i))
+		}
+	} else {
+		header, records = records[0], records[1:]
+	}
+
+	for _, record := range records {
+		row := make(map[string]interface{}, len(header))
+		for i, value := range record {
+			row[header[i]] = value
+		}
+		rows = append(rows, row)
+	}
+
+	return rows, nil
+}
@@ -1,13 +1,15 @@
 module github.com/m-mizutani/opaq
 
-go 1.17
+go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.2.1
 	github.com/go-ozzo/ozzo-validation/v4 v4.3.0
 	github.com/m-mizutani/goerr v0.1.2
 	github.com/m-mizutani/zlog v0.2.0
 	github.com/stretchr/testify v1.7.0
 	github.com/urfave/cli/v2 v2.3.0
+	golang.org/x/net v0.23.0
 	gopkg.in/yaml.v2 v2.2.3
 )
 
@@ -24,6 +26,7 @@ require (
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/russross/blackfriday/v2 v2.0.1 // indirect
 	github.com/shurcooL/sanitized_anchor_name v1.0.0 // indirect
-	golang.org/x/sys v0.0.0-20210927094055-39ccf1dd6fa6 // indirect
+	golang.org/x/sys v0.18.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
 	gopkg.in/yaml.v3 v3.0.0-20210107192922-496545a6307b // indirect
 )
@@ -2,17 +2,31 @@ package main_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/m-mizutani/goerr"
 	opaq "github.com/m-mizutani/opaq"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 )
 
 type stub struct {
@@ -129,14 +143,482 @@ func TestQuery(t *testing.T) {
 	})
 }
 
-func TestExit(t *testing.T) {
+func TestPassthrough(t *testing.T) {
 	ctx := context.Background()
+	const result = `{"b": 1.0,  "a":[1, 2]}`
 
-	t.Run("fail by fail-defined with defined response", func(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		args   []string
+		output string
+	}{
+		{
+			desc:   "write raw result verbatim with passthrough",
+			args:   []string{"--passthrough"},
+			output: result + "\n",
+		},
+		{
+			desc: "re-encode result without passthrough",
+			output: `{
+  "a": [
+    1,
+    2
+  ],
+  "b": 1.0
+}
+`,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"result":` + result + `}`))),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(&stdout),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+			}, tC.args...)...))
+			require.NoError(t, err)
+			assert.Equal(t, tC.output, stdout.String())
+		})
+	}
+}
+
+func TestEchoInput(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc  string
+		args  []string
+		field string
+	}{
+		{
+			desc:  "embed input with default field",
+			args:  []string{"--echo-input"},
+			field: "input",
+		},
+		{
+			desc:  "embed input with custom field",
+			args:  []string{"--echo-input", "--echo-input-field", "request"},
+			field: "request",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(&stdout),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+				"-m", "filename=five.json",
+			}, tC.args...)...))
+			require.NoError(t, err)
+
+			var output map[string]map[string]interface{}
+			require.NoError(t, json.Unmarshal(stdout.Bytes(), &output))
+			assert.Equal(t, true, output["result"]["allow"])
+			assert.Equal(t, "blue", output[tC.field]["user"])
+			assert.Equal(t, map[string]interface{}{"filename": "five.json"}, output[tC.field]["metadata"])
+		})
+	}
+}
+
+func TestDiscover(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc      string
+		args      []string
+		discovery func() (*http.Response, error)
+		queryURL  string
+		err       error
+	}{
+		{
+			desc: "query to discovered URL",
+			args: []string{"--discover", "https://discovery.example.com/opa"},
+			discovery: func() (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"url":"https://opa.example.com/v1/data/discovered"}`))),
+				}, nil
+			},
+			queryURL: "https://opa.example.com/v1/data/discovered",
+		},
+		{
+			desc: "fall back to --url if discovery fails",
+			args: []string{"--discover", "https://discovery.example.com/opa", "-u", "https://opa.example.com/v1/data/fallback"},
+			discovery: func() (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`not found`))),
+				}, nil
+			},
+			queryURL: "https://opa.example.com/v1/data/fallback",
+		},
+		{
+			desc: "fail if discovery fails without --url",
+			args: []string{"--discover", "https://discovery.example.com/opa"},
+			discovery: func() (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			err: opaq.ErrRequestFailed,
+		},
+		{
+			desc: "fail if discovered URL is invalid",
+			args: []string{"--discover", "https://discovery.example.com/opa"},
+			discovery: func() (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"url":"invalid_url"}`))),
+				}, nil
+			},
+			err: opaq.ErrUnexpectedResp,
+		},
+		{
+			desc: "fall back to --url if discovered URL is for another API version",
+			args: []string{"--discover", "https://discovery.example.com/opa", "-u", "https://opa.example.com/v1/data/fallback"},
+			discovery: func() (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"url":"https://opa.example.com/v0/data/discovered"}`))),
+				}, nil
+			},
+			queryURL: "https://opa.example.com/v1/data/fallback",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var queried int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					if r.URL.Host == "discovery.example.com" {
+						assert.Equal(t, http.MethodGet, r.Method)
+						assert.Equal(t, "ABC123", r.Header.Get("X-Token"))
+						assert.Empty(t, r.Header.Get("Authorization"))
+						return tC.discovery()
+					}
+
+					queried++
+					assert.Equal(t, tC.queryURL, r.URL.String())
+					assert.Equal(t, "Bearer opa-token", r.Header.Get("Authorization"))
+					assert.Empty(t, r.Header.Get("X-Token"))
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"--discover-header", "X-Token: ABC123",
+				"-H", "Authorization: Bearer opa-token",
+			}, tC.args...)...))
+
+			if tC.err != nil {
+				assert.ErrorIs(t, err, tC.err)
+				assert.Equal(t, 0, queried)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 1, queried)
+			}
+		})
+	}
+}
+
+func TestHTTPError(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc     string
+		do       func(r *http.Request) (*http.Response, error)
+		umbrella error
+		err      error
+	}{
+		{
+			desc: "connection failure",
+			do: func(r *http.Request) (*http.Response, error) {
+				return nil, errors.New("connection refused")
+			},
+			umbrella: opaq.ErrRequestFailed,
+			err:      opaq.ErrConnectionFailed,
+		},
+		{
+			desc: "non-200 status code",
+			do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusForbidden,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`forbidden`))),
+				}, nil
+			},
+			umbrella: opaq.ErrRequestFailed,
+			err:      opaq.ErrUnexpectedStatus,
+		},
+		{
+			desc: "malformed response body",
+			do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"result":`))),
+				}, nil
+			},
+			umbrella: opaq.ErrUnexpectedResp,
+			err:      opaq.ErrMalformedResp,
+		},
+		{
+			desc: "connection reset while reading response body",
+			do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body: ioutil.NopCloser(io.MultiReader(
+						strings.NewReader(`{"result":`),
+						iotest.ErrReader(errors.New("connection reset by peer")),
+					)),
+				}, nil
+			},
+			umbrella: opaq.ErrRequestFailed,
+			err:      opaq.ErrConnectionFailed,
+		},
+		{
+			desc: "broken gzip response body",
+			do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+					Body:       ioutil.NopCloser(strings.NewReader(`{"result":{}}`)),
+				}, nil
+			},
+			umbrella: opaq.ErrUnexpectedResp,
+			err:      opaq.ErrMalformedResp,
+		},
+		{
+			desc: "corrupted deflate data in gzip response body",
+			do: func(r *http.Request) (*http.Response, error) {
+				// valid gzip header followed by reserved (invalid) deflate block type
+				body := []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xff\xff\xff\xff")
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+					Body:       ioutil.NopCloser(bytes.NewReader(body)),
+				}, nil
+			},
+			umbrella: opaq.ErrUnexpectedResp,
+			err:      opaq.ErrMalformedResp,
+		},
+		{
+			desc: "connection reset while reading gzip response body",
+			do: func(r *http.Request) (*http.Response, error) {
+				var buf bytes.Buffer
+				gz := gzip.NewWriter(&buf)
+				_, err := gz.Write([]byte(`{"result":{"allow":true}}`))
+				require.NoError(t, err)
+				require.NoError(t, gz.Close())
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Encoding": []string{"gzip"}},
+					Body: ioutil.NopCloser(io.MultiReader(
+						bytes.NewReader(buf.Bytes()[:buf.Len()/2]),
+						iotest.ErrReader(errors.New("connection reset by peer")),
+					)),
+				}, nil
+			},
+			umbrella: opaq.ErrRequestFailed,
+			err:      opaq.ErrConnectionFailed,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: tC.do}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			).Cmd(ctx, args(
+				"-u", "https://opa.example.com/xxx", // URL
+			))
+			assert.ErrorIs(t, err, tC.umbrella)
+			assert.ErrorIs(t, err, tC.err)
+		})
+	}
+
+	t.Run("status code is available", func(t *testing.T) {
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`not found`))),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+		))
+
+		var goErr *goerr.Error
+		require.True(t, errors.As(err, &goErr))
+		assert.Equal(t, http.StatusNotFound, goErr.Values()["code"])
+	})
+}
+
+func TestGzipResponse(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := io.Copy(gz, toRespBody(t, &sampleResult{Allow: true}))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	testCases := []struct {
+		desc   string
+		header http.Header
+		body   []byte
+	}{
+		{
+			desc:   "decompress gzip encoded response",
+			header: http.Header{"Content-Encoding": []string{"gzip"}},
+			body:   buf.Bytes(),
+		},
+		{
+			desc: "read plain response if server ignores Accept-Encoding",
+			body: []byte(`{"result":{"allow":true}}`),
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					assert.Equal(t, "gzip", r.Header.Get("Accept-Encoding"))
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Header:     tC.header,
+						Body:       ioutil.NopCloser(bytes.NewReader(tC.body)),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(&stdout),
+			).Cmd(ctx, args(
+				"-u", "https://opa.example.com/xxx", // URL
+			))
+			require.NoError(t, err)
+
+			var result sampleResult
+			require.NoError(t, json.Unmarshal(stdout.Bytes(), &result))
+			assert.True(t, result.Allow)
+		})
+	}
+}
+
+func TestLargeIntegerResult(t *testing.T) {
+	var stdout bytes.Buffer
+	err := opaq.New(
+		opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"result":{"id":9007199254740993,"ts":1640995200123456789}}`))),
+			}, nil
+		}}),
+		opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		opaq.WithStdout(&stdout),
+	).Cmd(context.Background(), args(
+		"-u", "https://opa.example.com/xxx", // URL
+	))
+	require.NoError(t, err)
+
+	var result struct {
+		ID int64 `json:"id"`
+		TS int64 `json:"ts"`
+	}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &result))
+	assert.Equal(t, int64(9007199254740993), result.ID)
+	assert.Equal(t, int64(1640995200123456789), result.TS)
+}
+
+func TestLargeIntegerInput(t *testing.T) {
+	var called int
+	err := opaq.New(
+		opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+			called++
+			raw, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, `{"input":{"id":12345678901234567891,"ratio":0.1}}`, string(raw))
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       toRespBody(t, &sampleResult{Allow: true}),
+			}, nil
+		}}),
+		opaq.WithStdin(strings.NewReader(`{"id":12345678901234567891,"ratio":0.1}`)),
+		opaq.WithStdout(ioutil.Discard),
+	).Cmd(context.Background(), args(
+		"-u", "https://opa.example.com/v1/data/xxx", // URL
+	))
+	require.NoError(t, err)
+	assert.Equal(t, 1, called)
+}
+
+func TestGetMethod(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("send input as query parameter", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+				assert.Equal(t, http.MethodGet, r.Method)
+				assert.Equal(t, "opa.example.com", r.URL.Host)
+				assert.Equal(t, "/v1/data/xxx", r.URL.Path)
+				assert.Equal(t, "yes", r.URL.Query().Get("pretty"))
+				assert.Empty(t, r.Header.Get("Content-Type"))
+
+				var input map[string]interface{}
+				require.NoError(t, json.Unmarshal([]byte(r.URL.Query().Get("input")), &input))
+				assert.Equal(t, "blue & orange", input["user"])
+				assert.Equal(t, map[string]interface{}{"filename": "five.json"}, input["metadata"])
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue & orange"})),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/v1/data/xxx?pretty=yes", // URL
+			"-m", "filename=five.json",
+			"-X", "GET",
+		))
+		require.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("fall back to POST if input is too large", func(t *testing.T) {
 		var called int
 		err := opaq.New(
 			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
 				called++
+				assert.Equal(t, http.MethodPost, r.Method)
+				assert.Empty(t, r.URL.Query().Get("input"))
+
+				var input sampleInput
+				bindRequest(t, r.Body, &input)
+				assert.Equal(t, "blue", input.User)
 
 				return &http.Response{
 					StatusCode: http.StatusOK,
@@ -144,59 +626,1509 @@ func TestExit(t *testing.T) {
 				}, nil
 			}}),
 			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
 		).Cmd(ctx, args(
-			"-u", "https://opa.example.com/xxx", // URL
-			"--fail-defined",
+			"-u", "https://opa.example.com/v1/data/xxx", // URL
+			"-X", "GET",
+			"--max-query-length", "8",
 		))
-		assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+		require.NoError(t, err)
 		assert.Equal(t, 1, called)
 	})
+}
+
+func TestHTMLEscape(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		args   []string
+		output string
+	}{
+		{
+			desc:   "escape HTML by default",
+			output: "{\n  \"url\": \"https://example.com/?a=1\\u0026b=\\u003cc\\u003e\"\n}\n",
+		},
+		{
+			desc:   "do not escape HTML with no-html-escape",
+			args:   []string{"--no-html-escape"},
+			output: "{\n  \"url\": \"https://example.com/?a=1&b=<c>\"\n}\n",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, map[string]string{"url": "https://example.com/?a=1&b=<c>"}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(&stdout),
+			).Cmd(context.Background(), args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+			}, tC.args...)...))
+			require.NoError(t, err)
+			assert.Equal(t, tC.output, stdout.String())
+		})
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	var called int
+	err := opaq.New(
+		opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+			called++
+			assert.Equal(t, "true", r.URL.Query().Get("metrics"))
+			assert.Equal(t, "true", r.URL.Query().Get("pretty"))
+			assert.Equal(t, "/v1/data/xxx", r.URL.Path)
+
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body: ioutil.NopCloser(bytes.NewReader([]byte(`{
+  "result": {"allow": true},
+  "metrics": {"timer_rego_query_eval_ns": 12345}
+}`))),
+			}, nil
+		}}),
+		opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		opaq.WithStdout(&stdout),
+		opaq.WithStderr(&stderr),
+	).Cmd(context.Background(), args(
+		"-u", "https://opa.example.com/v1/data/xxx", // URL
+		"--server-metrics",
+		"--server-pretty",
+	))
+	require.NoError(t, err)
+	assert.Equal(t, 1, called)
+
+	// result output is not changed
+	assert.Equal(t, "{\n  \"allow\": true\n}\n", stdout.String())
+	assert.Equal(t, "server metrics:\n{\n  \"timer_rego_query_eval_ns\": 12345\n}\n", stderr.String())
+}
+
+func TestSARIFOutput(t *testing.T) {
+	ctx := context.Background()
+
+	type sarifResult struct {
+		RuleID  string `json:"ruleId"`
+		Level   string `json:"level"`
+		Message struct {
+			Text string `json:"text"`
+		} `json:"message"`
+		Locations []struct {
+			PhysicalLocation struct {
+				ArtifactLocation struct {
+					URI string `json:"uri"`
+				} `json:"artifactLocation"`
+				Region *struct {
+					StartLine int `json:"startLine"`
+				} `json:"region"`
+			} `json:"physicalLocation"`
+		} `json:"locations"`
+	}
+	type sarifLog struct {
+		Version string `json:"version"`
+		Runs    []struct {
+			Tool struct {
+				Driver struct {
+					Name  string `json:"name"`
+					Rules []struct {
+						ID string `json:"id"`
+					} `json:"rules"`
+				} `json:"driver"`
+			} `json:"tool"`
+			Results []sarifResult `json:"results"`
+		} `json:"runs"`
+	}
+
+	run := func(t *testing.T, body string, argv ...string) *sarifLog {
+		var stdout bytes.Buffer
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(strings.NewReader(body)),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(&stdout),
+		).Cmd(ctx, args(append([]string{
+			"-u", "https://opa.example.com/v1/data/xxx", // URL
+			"--output-format", "sarif",
+		}, argv...)...))
+		require.NoError(t, err)
+
+		var log sarifLog
+		require.NoError(t, json.Unmarshal(stdout.Bytes(), &log))
+		assert.Equal(t, "2.1.0", log.Version)
+		require.Len(t, log.Runs, 1)
+		assert.Equal(t, "opaq", log.Runs[0].Tool.Driver.Name)
+		return &log
+	}
+
+	t.Run("violation objects with location", func(t *testing.T) {
+		log := run(t, `{"result":{"violation":[
+			{"msg":"root user is not allowed","id":"no-root","severity":"high","file":"Dockerfile","line":3},
+			{"msg":"latest tag","rule":"pin-tag","level":"warning"}
+		]}}`)
+
+		results := log.Runs[0].Results
+		require.Len(t, results, 2)
+		assert.Equal(t, "no-root", results[0].RuleID)
+		assert.Equal(t, "error", results[0].Level)
+		assert.Equal(t, "root user is not allowed", results[0].Message.Text)
+		require.Len(t, results[0].Locations, 1)
+		assert.Equal(t, "Dockerfile", results[0].Locations[0].PhysicalLocation.ArtifactLocation.URI)
+		require.NotNil(t, results[0].Locations[0].PhysicalLocation.Region)
+		assert.Equal(t, 3, results[0].Locations[0].PhysicalLocation.Region.StartLine)
+
+		assert.Equal(t, "pin-tag", results[1].RuleID)
+		assert.Equal(t, "warning", results[1].Level)
+		assert.Empty(t, results[1].Locations)
+
+		rules := log.Runs[0].Tool.Driver.Rules
+		require.Len(t, rules, 2)
+		assert.Equal(t, "no-root", rules[0].ID)
+		assert.Equal(t, "pin-tag", rules[1].ID)
+	})
+
+	t.Run("deny and warn messages with location from metadata", func(t *testing.T) {
+		log := run(t, `{"result":{"deny":["denied"],"warn":["warned"],"allow":false}}`,
+			"-m", "filename=five.json")
+
+		results := log.Runs[0].Results
+		require.Len(t, results, 2)
+		assert.Equal(t, "deny", results[0].RuleID)
+		assert.Equal(t, "error", results[0].Level)
+		assert.Equal(t, "denied", results[0].Message.Text)
+		assert.Equal(t, "warn", results[1].RuleID)
+		assert.Equal(t, "warning", results[1].Level)
+		for _, result := range results {
+			require.Len(t, result.Locations, 1)
+			assert.Equal(t, "five.json", result.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+			assert.Nil(t, result.Locations[0].PhysicalLocation.Region)
+		}
+	})
+
+	t.Run("array result is list of violations", func(t *testing.T) {
+		log := run(t, `{"result":["bad"]}`)
+		results := log.Runs[0].Results
+		require.Len(t, results, 1)
+		assert.Equal(t, "violation", results[0].RuleID)
+		assert.Equal(t, "bad", results[0].Message.Text)
+	})
+
+	t.Run("no violation is empty results", func(t *testing.T) {
+		log := run(t, `{"result":{"allow":true}}`)
+		assert.NotNil(t, log.Runs[0].Results)
+		assert.Empty(t, log.Runs[0].Results)
+	})
+}
+
+func TestSortedOutput(t *testing.T) {
+	const body = `{"result":{"zeta":{"b":1,"a":{"y":true,"x":false}},"alpha":[{"d":"4","c":"3"}],"mid":null}}`
+	const expected = `{
+  "alpha": [
+    {
+      "c": "3",
+      "d": "4"
+    }
+  ],
+  "mid": null,
+  "zeta": {
+    "a": {
+      "x": false,
+      "y": true
+    },
+    "b": 1
+  }
+}
+`
+
+	for i := 0; i < 10; i++ {
+		var stdout bytes.Buffer
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(body))),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(&stdout),
+		).Cmd(context.Background(), args(
+			"-u", "https://opa.example.com/xxx", // URL
+		))
+		require.NoError(t, err)
+		require.Equal(t, expected, stdout.String())
+	}
+}
+
+func TestAPIVersion(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc     string
+		url      string
+		args     []string
+		request  func(t *testing.T, body []byte)
+		response string
+	}{
+		{
+			desc: "v1 API wraps input and result",
+			url:  "https://opa.example.com/v1/data/xxx",
+			args: []string{"--api-version", "v1"},
+			request: func(t *testing.T, body []byte) {
+				var req map[string]map[string]interface{}
+				require.NoError(t, json.Unmarshal(body, &req))
+				assert.Equal(t, "blue", req["input"]["user"])
+			},
+			response: `{"result":{"allow":true}}`,
+		},
+		{
+			desc: "v0 API sends input and receives result as it is",
+			url:  "https://opa.example.com/v0/data/xxx",
+			args: []string{"--api-version", "v0"},
+			request: func(t *testing.T, body []byte) {
+				var req map[string]interface{}
+				require.NoError(t, json.Unmarshal(body, &req))
+				assert.Equal(t, "blue", req["user"])
+				assert.NotContains(t, req, "input")
+			},
+			response: `{"allow":true}`,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stdout bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					body, err := ioutil.ReadAll(r.Body)
+					require.NoError(t, err)
+					tC.request(t, body)
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       ioutil.NopCloser(bytes.NewReader([]byte(tC.response))),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(&stdout),
+			).Cmd(ctx, args(append([]string{"-u", tC.url}, tC.args...)...))
+			require.NoError(t, err)
+
+			var result sampleResult
+			require.NoError(t, json.Unmarshal(stdout.Bytes(), &result))
+			assert.True(t, result.Allow)
+		})
+	}
+
+	t.Run("v0 API undefined document is empty result", func(t *testing.T) {
+		var stdout bytes.Buffer
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusNotFound,
+					Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"code":"undefined_document","message":"document missing or undefined: data.xxx"}`))),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(&stdout),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/v0/data/xxx",
+			"--api-version", "v0",
+			"--fail-undefined",
+		))
+		assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+		assert.Equal(t, "null\n", stdout.String())
+	})
+}
+
+func TestSignRequest(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc   string
+		args   []string
+		env    string
+		header string
+	}{
+		{
+			desc:   "sign with default header",
+			env:    "OPAQ_SIGN_KEY",
+			header: "X-Signature",
+		},
+		{
+			desc:   "sign with custom header",
+			args:   []string{"--sign-header", "X-Hub-Signature"},
+			env:    "OPAQ_SIGN_KEY",
+			header: "X-Hub-Signature",
+		},
+		{
+			desc:   "sign with key of custom env var",
+			args:   []string{"--sign-key-env", "MY_SIGN_KEY"},
+			env:    "MY_SIGN_KEY",
+			header: "X-Signature",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv(tC.env, "my-secret")
+
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					body, err := ioutil.ReadAll(r.Body)
+					require.NoError(t, err)
+
+					mac := hmac.New(sha256.New, []byte("my-secret"))
+					_, err = mac.Write(body)
+					require.NoError(t, err)
+					assert.Equal(t, hex.EncodeToString(mac.Sum(nil)), r.Header.Get(tC.header))
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+			}, tC.args...)...))
+			require.NoError(t, err)
+			assert.Equal(t, 1, called)
+		})
+	}
+
+	t.Run("sign key is not accepted by argument", func(t *testing.T) {
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				t.Error("request must not be sent")
+				return nil, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--sign-key", "my-secret",
+		))
+		require.Error(t, err)
+	})
+
+	t.Run("no signature without key", func(t *testing.T) {
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				assert.Empty(t, r.Header.Get("X-Signature"))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+		))
+		require.NoError(t, err)
+	})
+}
+
+func TestProtectedHeader(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc        string
+		args        []string
+		contentType string
+		token       string
+		host        string
+		err         error
+	}{
+		{
+			desc: "reject Content-Type",
+			args: []string{"-H", "Content-Type: text/plain"},
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "reject Host in case insensitive",
+			args: []string{"-H", "host: evil.example.com"},
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc:        "allow normal header including colon in value",
+			args:        []string{"-H", "X-Token: https://token.example.com:8443/xxx"},
+			contentType: "application/json",
+			token:       "https://token.example.com:8443/xxx",
+		},
+		{
+			desc:        "allow protected header with override option",
+			args:        []string{"-H", "Content-Type: application/vnd.custom+json", "--allow-protected-headers"},
+			contentType: "application/vnd.custom+json",
+		},
+		{
+			desc:        "override Host with override option",
+			args:        []string{"-H", "Host: internal.example.com", "--allow-protected-headers"},
+			contentType: "application/json",
+			host:        "internal.example.com",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					assert.Equal(t, []string{tC.contentType}, r.Header.Values("Content-Type"))
+					assert.Equal(t, tC.token, r.Header.Get("X-Token"))
+					if tC.host != "" {
+						assert.Equal(t, tC.host, r.Host)
+					} else {
+						assert.Equal(t, "opa.example.com", r.Host)
+					}
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+			}, tC.args...)...))
+
+			if tC.err != nil {
+				assert.ErrorIs(t, err, tC.err)
+				assert.Equal(t, 0, called)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 1, called)
+			}
+		})
+	}
+}
+
+func TestHeaderEnv(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("header value is read from environment variable", func(t *testing.T) {
+		t.Setenv("OPAQ_TEST_TOKEN", "Bearer xxx")
+
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+				assert.Equal(t, "Bearer xxx", r.Header.Get("Authorization"))
+				assert.Equal(t, "blue", r.Header.Get("X-Color"))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--header-env", "Authorization=OPAQ_TEST_TOKEN",
+			"-H", "X-Color: blue",
+		))
+		require.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+
+	testCases := []struct {
+		desc string
+		args []string
+	}{
+		{
+			desc: "unset environment variable fails",
+			args: []string{"--header-env", "Authorization=OPAQ_TEST_NOT_SET"},
+		},
+		{
+			desc: "invalid format fails",
+			args: []string{"--header-env", "Authorization: OPAQ_TEST_TOKEN"},
+		},
+		{
+			desc: "protected header fails",
+			args: []string{"--header-env", "Host=OPAQ_TEST_TOKEN"},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv("OPAQ_TEST_TOKEN", "Bearer xxx")
+
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+			}, tC.args...)...))
+			assert.ErrorIs(t, err, opaq.ErrInvalidConfiguration)
+			assert.Equal(t, 0, called)
+		})
+	}
+}
+
+func TestNDJSON(t *testing.T) {
+	ctx := context.Background()
+
+	ndjsonResp := func(t *testing.T, lines ...string) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Type": []string{"application/x-ndjson"}},
+			Body:       ioutil.NopCloser(strings.NewReader(strings.Join(lines, "\n") + "\n")),
+		}
+	}
+
+	t.Run("documents are sent as lines and results are listed", func(t *testing.T) {
+		var called int
+		stdout := &bytes.Buffer{}
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+				assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+				raw, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, `{"input":{"metadata":{"file":"x"},"mydata":{"user":"blue"}}}`+"\n"+
+					`{"input":{"metadata":{"file":"x"},"mydata":{"user":"orange"}}}`+"\n", string(raw))
+
+				return ndjsonResp(t, `{"result":{"allow":true}}`, `{}`), nil
+			}}),
+			opaq.WithStdin(strings.NewReader(`{"user":"blue"} {"user":"orange"}`)),
+			opaq.WithStdout(stdout),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--ndjson",
+			"--data-field", "mydata",
+			"-m", "file=x",
+		))
+		require.NoError(t, err)
+		assert.Equal(t, 1, called)
+		assert.JSONEq(t, `[{"allow":true},null]`, stdout.String())
+	})
+
+	t.Run("fail-undefined checks each result", func(t *testing.T) {
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				return ndjsonResp(t, `{"result":{"allow":true}}`, `{}`), nil
+			}}),
+			opaq.WithStdin(strings.NewReader(`{"user":"blue"} {"user":"orange"}`)),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--ndjson",
+			"--fail-undefined",
+		))
+		assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+	})
+
+	t.Run("server not supporting NDJSON fails", func(t *testing.T) {
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Header:     http.Header{"Content-Type": []string{"application/json"}},
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--ndjson",
+		))
+		assert.ErrorIs(t, err, opaq.ErrUnexpectedResp)
+	})
+
+	t.Run("mismatched number of results fails", func(t *testing.T) {
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				return ndjsonResp(t, `{"result":true}`), nil
+			}}),
+			opaq.WithStdin(strings.NewReader(`{"user":"blue"} {"user":"orange"}`)),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--ndjson",
+		))
+		assert.ErrorIs(t, err, opaq.ErrUnexpectedResp)
+	})
+}
+
+func TestURLWarning(t *testing.T) {
+	testCases := []struct {
+		desc string
+		url  string
+		args []string
+		warn string
+	}{
+		{
+			desc: "root URL of OPA server",
+			url:  "https://opa.example.com",
+			warn: "https://opa.example.com/v1/data/{package path}",
+		},
+		{
+			desc: "hint follows API version",
+			url:  "https://opa.example.com/authz",
+			args: []string{"--api-version", "v0"},
+			warn: "https://opa.example.com/v0/data/{package path}",
+		},
+		{
+			desc: "v1 Data API path",
+			url:  "https://opa.example.com/v1/data/authz/allow",
+		},
+		{
+			desc: "v0 Data API path under gateway prefix",
+			url:  "https://gw.example.com/opa/v0/data/authz",
+			args: []string{"--api-version", "v0"},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(&stdout),
+				opaq.WithStderr(&stderr),
+			).Cmd(context.Background(), args(append([]string{"-u", tC.url}, tC.args...)...))
+			require.NoError(t, err)
+
+			// warning must not corrupt result output
+			assert.NotContains(t, stdout.String(), "Data API")
+			if tC.warn != "" {
+				assert.Contains(t, stderr.String(), "URL path does not look like Data API")
+				assert.Contains(t, stderr.String(), tC.warn)
+			} else {
+				assert.Empty(t, stderr.String())
+			}
+		})
+	}
+}
+
+func TestExit(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("fail by fail-defined with defined response", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--fail-defined",
+		))
+		assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("exit normally by fail-defined with undefined response", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &struct{}{}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--fail-defined",
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("fail by fail-undefined with undefined response", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &struct{}{}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--fail-undefined",
+		))
+		assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("exit normally by fail-undefined with defined response", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"--fail-undefined",
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+}
+
+func TestExitCodeContract(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc  string
+		body  string
+		empty bool
+	}{
+		{desc: "missing result", body: `{}`, empty: true},
+		{desc: "null result", body: `{"result":null}`, empty: true},
+		{desc: "empty object", body: `{"result":{}}`, empty: true},
+		{desc: "empty array", body: `{"result":[]}`, empty: true},
+		{desc: "false", body: `{"result":false}`, empty: false},
+		{desc: "zero", body: `{"result":0}`, empty: false},
+		{desc: "empty string", body: `{"result":""}`, empty: false},
+		{desc: "non-empty object", body: `{"result":{"allow":false}}`, empty: false},
+		{desc: "non-empty array", body: `{"result":[false]}`, empty: false},
+	}
+
+	flags := []struct {
+		name      string
+		failEmpty bool
+	}{
+		{name: "--fail-defined", failEmpty: false},
+		{name: "--fail-non-empty", failEmpty: false},
+		{name: "--fail-undefined", failEmpty: true},
+		{name: "--fail-empty", failEmpty: true},
+	}
+
+	for _, tC := range testCases {
+		for _, flag := range flags {
+			t.Run(tC.desc+" with "+flag.name, func(t *testing.T) {
+				err := opaq.New(
+					opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+						return &http.Response{
+							StatusCode: http.StatusOK,
+							Body:       ioutil.NopCloser(bytes.NewReader([]byte(tC.body))),
+						}, nil
+					}}),
+					opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+					opaq.WithStdout(ioutil.Discard),
+				).Cmd(ctx, args(
+					"-u", "https://opa.example.com/xxx", // URL
+					flag.name,
+				))
+
+				if tC.empty == flag.failEmpty {
+					assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+				} else {
+					assert.NoError(t, err)
+				}
+			})
+		}
+	}
+}
+
+func TestInput(t *testing.T) {
+	ctx := context.Background()
+	t.Run("input yaml format", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+				var input map[string]interface{}
+				bindRequest(t, r.Body, &input)
+				assert.Equal(t, "blue", input["color"])
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &struct{}{}),
+				}, nil
+			}}),
+			opaq.WithStdin(bytes.NewReader([]byte(`
+color: blue
+`))),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"-f", "yaml",
+			"--fail-defined",
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("accept multiple yaml document", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+				var input []map[string]interface{}
+				bindRequest(t, r.Body, &input)
+				require.Len(t, input, 2)
+				assert.Equal(t, "blue", input[0]["color"])
+				assert.Equal(t, "orange", input[1]["color"])
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &struct{}{}),
+				}, nil
+			}}),
+			opaq.WithStdin(bytes.NewReader([]byte(`
+color: blue
+---
+color: orange
+`))),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"-f", "yaml",
+			"--fail-defined",
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("accept multiple json document", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+				var input []map[string]interface{}
+				bindRequest(t, r.Body, &input)
+				require.Len(t, input, 2)
+				assert.Equal(t, "blue", input[0]["color"])
+				assert.Equal(t, "orange", input[1]["color"])
+
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &struct{}{}),
+				}, nil
+			}}),
+			opaq.WithStdin(bytes.NewReader([]byte(`
+{"color":"blue"}
+{"color":"orange"}
+`))),
+		).Cmd(ctx, args(
+			"-u", "https://opa.example.com/xxx", // URL
+			"-f", "json",
+			"--fail-defined",
+		))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+
+}
+
+func writeTempFileWithExt(t *testing.T, ext, data string) string {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "input"+ext)
+	require.NoError(t, ioutil.WriteFile(path, []byte(data), 0600))
+	return path
+}
+
+func TestCSVInput(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc   string
+		argv   []string
+		ext    string
+		stdin  string
+		expect string
+		errMsg string
+	}{
+		{
+			desc:   "rows are keyed by header",
+			argv:   []string{"-f", "csv"},
+			stdin:  "user,role\nblue,admin\norange,guest\n",
+			expect: `[{"user":"blue","role":"admin"},{"user":"orange","role":"guest"}]`,
+		},
+		{
+			desc:   "positional keys without header",
+			argv:   []string{"-f", "csv", "--csv-no-header"},
+			stdin:  "blue,admin\norange,guest\n",
+			expect: `[{"0":"blue","1":"admin"},{"0":"orange","1":"guest"}]`,
+		},
+		{
+			desc:   "header only is empty list",
+			argv:   []string{"-f", "csv"},
+			stdin:  "user,role\n",
+			expect: `[]`,
+		},
+		{
+			desc:   ".csv file is detected by extension",
+			ext:    ".csv",
+			stdin:  "user,role\nblue,admin\n",
+			expect: `[{"user":"blue","role":"admin"}]`,
+		},
+		{
+			desc:   "inconsistent number of columns fails",
+			argv:   []string{"-f", "csv"},
+			stdin:  "user,role\nblue\n",
+			errMsg: "wrong number of fields",
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			argv := append([]string{"-u", "https://opa.example.com/xxx"}, tC.argv...)
+			stdin := tC.stdin
+			if tC.ext != "" {
+				argv = append(argv, "-i", writeTempFileWithExt(t, tC.ext, tC.stdin))
+				stdin = ""
+			}
+
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					var input json.RawMessage
+					bindRequest(t, r.Body, &input)
+					assert.JSONEq(t, tC.expect, string(input))
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(bytes.NewReader([]byte(stdin))),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(argv...))
+
+			if tC.errMsg != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tC.errMsg)
+				assert.Equal(t, 0, called)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 1, called)
+			}
+		})
+	}
+}
+
+func TestMaxInputBytes(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc  string
+		input string
+		args  []string
+		err   error
+	}{
+		{
+			desc:  "input within limit",
+			input: `{"user":"blue"}`,
+			args:  []string{"--max-input-bytes", "15"},
+		},
+		{
+			desc:  "oversized input fails",
+			input: `{"user":"blue"}`,
+			args:  []string{"--max-input-bytes", "14"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "oversized yaml input fails",
+			input: "user: blue\ncolor: orange\n",
+			args:  []string{"--max-input-bytes", "10", "-f", "yaml"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "zero means unlimited",
+			input: `{"user":"blue"}`,
+			args:  []string{"--max-input-bytes", "0"},
+		},
+		{
+			desc:  "negative limit fails",
+			input: `{"user":"blue"}`,
+			args:  []string{"--max-input-bytes", "-1"},
+			err:   opaq.ErrInvalidConfiguration,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(strings.NewReader(tC.input)),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+			}, tC.args...)...))
+
+			if tC.err != nil {
+				assert.ErrorIs(t, err, tC.err)
+				assert.Equal(t, 0, called)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 1, called)
+			}
+		})
+	}
+}
+
+func TestDecodeBase64(t *testing.T) {
+	ctx := context.Background()
+	enc := base64.StdEncoding.EncodeToString
+
+	inner := enc([]byte(`{"user":"blue"}`))
+	nested := enc([]byte(`{"type":"login","payload":"` + inner + `"}`))
+
+	testCases := []struct {
+		desc   string
+		input  string
+		args   []string
+		expect string
+		err    error
+	}{
+		{
+			desc:   "decode a field",
+			input:  `{"event":{"payload":"` + inner + `"}}`,
+			args:   []string{"--decode-base64", "/event/payload"},
+			expect: `{"event":{"payload":{"user":"blue"}}}`,
+		},
+		{
+			desc:   "decode nested payload in order",
+			input:  `{"data":"` + nested + `"}`,
+			args:   []string{"--decode-base64", "/data", "--decode-base64", "/data/payload"},
+			expect: `{"data":{"type":"login","payload":{"user":"blue"}}}`,
+		},
+		{
+			desc:   "URL-safe encoding",
+			input:  `{"data":"` + base64.URLEncoding.EncodeToString([]byte(`{"q":"??>"}`)) + `"}`,
+			args:   []string{"--decode-base64", "/data"},
+			expect: `{"data":{"q":"??>"}}`,
+		},
+		{
+			desc:   "decode elements of array by index",
+			input:  `{"items":[{"payload":"` + inner + `"},"` + inner + `"]}`,
+			args:   []string{"--decode-base64", "/items/0/payload", "--decode-base64", "/items/1"},
+			expect: `{"items":[{"payload":{"user":"blue"}},{"user":"blue"}]}`,
+		},
+		{
+			desc:  "index out of range fails",
+			input: `{"items":["` + inner + `"]}`,
+			args:  []string{"--decode-base64", "/items/1"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "index with leading zero fails",
+			input: `{"items":["` + inner + `"]}`,
+			args:  []string{"--decode-base64", "/items/00"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "missing field fails",
+			input: `{"event":{}}`,
+			args:  []string{"--decode-base64", "/event/payload"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "not string field fails",
+			input: `{"event":{"payload":1}}`,
+			args:  []string{"--decode-base64", "/event/payload"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "invalid base64 fails",
+			input: `{"data":"!!!"}`,
+			args:  []string{"--decode-base64", "/data"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "decoded data not JSON fails",
+			input: `{"data":"` + enc([]byte("not json")) + `"}`,
+			args:  []string{"--decode-base64", "/data"},
+			err:   opaq.ErrInvalidInput,
+		},
+		{
+			desc:  "not JSON pointer fails",
+			input: `{"data":"` + inner + `"}`,
+			args:  []string{"--decode-base64", "data"},
+			err:   opaq.ErrInvalidConfiguration,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					var input json.RawMessage
+					bindRequest(t, r.Body, &input)
+					assert.JSONEq(t, tC.expect, string(input))
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(strings.NewReader(tC.input)),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/v1/data/xxx", // URL
+			}, tC.args...)...))
+
+			if tC.err != nil {
+				assert.ErrorIs(t, err, tC.err)
+				assert.Equal(t, 0, called)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 1, called)
+			}
+		})
+	}
+}
+
+func TestAutoFormat(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc    string
+		ext     string
+		stdin   string
+		data    string
+		palette bool
+	}{
+		{
+			desc: ".json file",
+			ext:  ".json",
+			data: `{"color":"blue"}`,
+		},
+		{
+			desc: ".yaml file",
+			ext:  ".yaml",
+			data: "color: blue\n",
+		},
+		{
+			desc: ".yml file",
+			ext:  ".yml",
+			data: "color: blue\n",
+		},
+		{
+			desc: ".toml file",
+			ext:  ".toml",
+			data: "color = \"blue\"\n",
+		},
+		{
+			desc: "unknown extension is sniffed",
+			ext:  ".txt",
+			data: "color: blue\n",
+		},
+		{
+			desc:  "json from stdin",
+			stdin: "\n  {\"color\":\"blue\"}",
+		},
+		{
+			desc:  "yaml from stdin",
+			stdin: "# comment\ncolor: blue\n",
+		},
+		{
+			desc:  "toml from stdin",
+			stdin: "# comment\ncolor = \"blue\"\n",
+		},
+		{
+			desc:    "toml table from stdin",
+			stdin:   "[palette]\nname = \"x\"\n\n[root]\n",
+			palette: true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			argv := []string{"-u", "https://opa.example.com/xxx"}
+			if tC.ext != "" {
+				argv = append(argv, "-i", writeTempFileWithExt(t, tC.ext, tC.data))
+			}
+
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					var input map[string]interface{}
+					bindRequest(t, r.Body, &input)
+					if tC.palette {
+						assert.Equal(t, map[string]interface{}{"name": "x"}, input["palette"])
+					} else {
+						assert.Equal(t, "blue", input["color"])
+					}
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(bytes.NewReader([]byte(tC.stdin))),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(argv...))
+			require.NoError(t, err)
+			assert.Equal(t, 1, called)
+		})
+	}
+
+	t.Run("json scalar from stdin keeps precision", func(t *testing.T) {
+		var called int
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				called++
+				body, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, `{"input":12345678901234567890123}`, string(body))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(strings.NewReader("12345678901234567890123\n")),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args("-u", "https://opa.example.com/xxx"))
+		require.NoError(t, err)
+		assert.Equal(t, 1, called)
+	})
+
+	t.Run("yaml list from stdin is not json", func(t *testing.T) {
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				body, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				assert.Equal(t, `{"input":["blue","orange"]}`, string(body))
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdin(strings.NewReader("- blue\n- orange\n")),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args("-u", "https://opa.example.com/xxx"))
+		require.NoError(t, err)
+	})
+
+	t.Run("explicit format overrides extension", func(t *testing.T) {
+		path := writeTempFileWithExt(t, ".json", "color: blue\n")
+		err := opaq.New(
+			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+				var input map[string]interface{}
+				bindRequest(t, r.Body, &input)
+				assert.Equal(t, "blue", input["color"])
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
+				}, nil
+			}}),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(ctx, args("-u", "https://opa.example.com/xxx", "-i", path, "-f", "yaml"))
+		require.NoError(t, err)
+	})
+}
+
+func TestMalformedInput(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc   string
+		input  string
+		line   int
+		column int
+	}{
+		{
+			desc:   "trailing garbage",
+			input:  "{\"color\":\"blue\"}\n{\"color\":\"orange\"}\nxyz",
+			line:   3,
+			column: 1,
+		},
+		{
+			desc:   "invalid character in object",
+			input:  "{\"color\":\n  \"blue\",,}",
+			line:   2,
+			column: 10,
+		},
+		{
+			desc:   "truncated trailing document",
+			input:  "{\"color\":\"blue\"}\n{\"color\":",
+			line:   2,
+			column: 10,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					t.Error("should not be called")
+					return nil, nil
+				}}),
+				opaq.WithStdin(bytes.NewReader([]byte(tC.input))),
+			).Cmd(ctx, args(
+				"-u", "https://opa.example.com/xxx", // URL
+			))
+			require.Error(t, err)
+
+			var goErr *goerr.Error
+			require.True(t, errors.As(err, &goErr))
+			assert.Equal(t, tC.line, goErr.Values()["line"])
+			assert.Equal(t, tC.column, goErr.Values()["column"])
+		})
+	}
+}
+
+func TestSingleInput(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc   string
+		format string
+		input  string
+		err    error
+	}{
+		{
+			desc:   "accept one json document",
+			format: "json",
+			input:  `{"color":"blue"}`,
+		},
+		{
+			desc:   "reject multiple json documents",
+			format: "json",
+			input:  `{"color":"blue"} {"color":"orange"}`,
+			err:    opaq.ErrInvalidInput,
+		},
+		{
+			desc:   "reject multiple yaml documents",
+			format: "yaml",
+			input:  "color: blue\n---\ncolor: orange\n",
+			err:    opaq.ErrInvalidInput,
+		},
+		{
+			desc:   "reject no document",
+			format: "json",
+			input:  ``,
+			err:    opaq.ErrInvalidInput,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(bytes.NewReader([]byte(tC.input))),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(
+				"-u", "https://opa.example.com/xxx", // URL
+				"-f", tC.format,
+				"--single",
+			))
 
-	t.Run("exit normally by fail-defined with undefined response", func(t *testing.T) {
-		var called int
-		err := opaq.New(
-			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
-				called++
+			if tC.err != nil {
+				assert.ErrorIs(t, err, tC.err)
+				assert.Equal(t, 0, called)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, 1, called)
+			}
+		})
+	}
+}
 
-				return &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &struct{}{}),
-				}, nil
-			}}),
-			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
-		).Cmd(ctx, args(
-			"-u", "https://opa.example.com/xxx", // URL
-			"--fail-defined",
-		))
-		assert.NoError(t, err)
-		assert.Equal(t, 1, called)
-	})
+func TestMetadata(t *testing.T) {
+	ctx := context.Background()
 
-	t.Run("fail by fail-undefined with undefined response", func(t *testing.T) {
+	t.Run("inject metadata", func(t *testing.T) {
 		var called int
 		err := opaq.New(
 			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
 				called++
+				var input map[string]interface{}
+
+				bindRequest(t, r.Body, &input)
+				assert.Equal(t, "blue", input["user"])
+				metadata, ok := input["metadata"].(map[string]interface{})
+				require.True(t, ok)
+				require.NotNil(t, metadata)
+				assert.Equal(t, "five.json", metadata["filename"])
 
 				return &http.Response{
 					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &struct{}{}),
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
 				}, nil
 			}}),
 			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
 		).Cmd(ctx, args(
 			"-u", "https://opa.example.com/xxx", // URL
-			"--fail-undefined",
+			"-m", "filename=five.json",
 		))
-		assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+		require.NoError(t, err)
 		assert.Equal(t, 1, called)
 	})
 
-	t.Run("exit normally by fail-undefined with defined response", func(t *testing.T) {
+	t.Run("change metadata field name", func(t *testing.T) {
 		var called int
 		err := opaq.New(
 			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
 				called++
+				var input map[string]interface{}
+
+				bindRequest(t, r.Body, &input)
+
+				// not found by default name
+				_, ok := input["metadata"].(map[string]interface{})
+				assert.False(t, ok)
+
+				// found in specified field name
+				metadata, ok := input["metaverse"].(map[string]interface{})
+				require.True(t, ok)
+				require.NotNil(t, metadata)
+				assert.Equal(t, "five.json", metadata["filename"])
 
 				return &http.Response{
 					StatusCode: http.StatusOK,
@@ -206,231 +2138,841 @@ func TestExit(t *testing.T) {
 			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
 		).Cmd(ctx, args(
 			"-u", "https://opa.example.com/xxx", // URL
-			"--fail-undefined",
+			"-m", "filename=five.json",
+			"--metadata-field", "metaverse",
 		))
-		assert.NoError(t, err)
+		require.NoError(t, err)
 		assert.Equal(t, 1, called)
 	})
-}
 
-func TestInput(t *testing.T) {
-	ctx := context.Background()
-	t.Run("input yaml format", func(t *testing.T) {
+	t.Run("change data path", func(t *testing.T) {
 		var called int
 		err := opaq.New(
 			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
 				called++
 				var input map[string]interface{}
+
 				bindRequest(t, r.Body, &input)
-				assert.Equal(t, "blue", input["color"])
+				assert.Nil(t, input["user"])
+				data, ok := input["mydata"].(map[string]interface{})
+				require.True(t, ok)
+				assert.Equal(t, "blue", data["user"])
+
+				metadata, ok := input["metadata"].(map[string]interface{})
+				require.True(t, ok)
+				require.NotNil(t, metadata)
+				assert.Equal(t, "five.json", metadata["filename"])
 
 				return &http.Response{
 					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &struct{}{}),
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
 				}, nil
 			}}),
-			opaq.WithStdin(bytes.NewReader([]byte(`
-color: blue
-`))),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
 		).Cmd(ctx, args(
 			"-u", "https://opa.example.com/xxx", // URL
-			"-f", "yaml",
-			"--fail-defined",
+			"-m", "filename=five.json",
+			"--data-field", "mydata",
 		))
-		assert.NoError(t, err)
+		require.NoError(t, err)
 		assert.Equal(t, 1, called)
 	})
 
-	t.Run("accept multiple yaml document", func(t *testing.T) {
+	t.Run("no metadata and set only data field name", func(t *testing.T) {
 		var called int
 		err := opaq.New(
 			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
 				called++
-				var input []map[string]interface{}
+				var input map[string]interface{}
+
 				bindRequest(t, r.Body, &input)
-				require.Len(t, input, 2)
-				assert.Equal(t, "blue", input[0]["color"])
-				assert.Equal(t, "orange", input[1]["color"])
+				assert.Nil(t, input["user"])
+				data, ok := input["mydata"].(map[string]interface{})
+				require.True(t, ok)
+				assert.Equal(t, "blue", data["user"])
+
+				_, ok = input["metadata"].(map[string]interface{})
+				require.False(t, ok)
 
 				return &http.Response{
 					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &struct{}{}),
+					Body:       toRespBody(t, &sampleResult{Allow: true}),
 				}, nil
 			}}),
-			opaq.WithStdin(bytes.NewReader([]byte(`
-color: blue
----
-color: orange
-`))),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
 		).Cmd(ctx, args(
 			"-u", "https://opa.example.com/xxx", // URL
-			"-f", "yaml",
-			"--fail-defined",
+			"--data-field", "mydata",
 		))
-		assert.NoError(t, err)
+		require.NoError(t, err)
 		assert.Equal(t, 1, called)
 	})
+}
 
-	t.Run("accept multiple json document", func(t *testing.T) {
-		var called int
-		err := opaq.New(
-			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
-				called++
-				var input []map[string]interface{}
-				bindRequest(t, r.Body, &input)
-				require.Len(t, input, 2)
-				assert.Equal(t, "blue", input[0]["color"])
-				assert.Equal(t, "orange", input[1]["color"])
+func TestDataFieldPointer(t *testing.T) {
+	ctx := context.Background()
 
-				return &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &struct{}{}),
-				}, nil
-			}}),
-			opaq.WithStdin(bytes.NewReader([]byte(`
-{"color":"blue"}
-{"color":"orange"}
-`))),
-		).Cmd(ctx, args(
-			"-u", "https://opa.example.com/xxx", // URL
-			"-f", "json",
-			"--fail-defined",
-		))
-		assert.NoError(t, err)
-		assert.Equal(t, 1, called)
-	})
+	testCases := []struct {
+		desc   string
+		args   []string
+		expect string
+	}{
+		{
+			desc:   "nest input with multi-level pointer",
+			args:   []string{"--data-field", "/context/request"},
+			expect: `{"context":{"request":{"user":"blue"}}}`,
+		},
+		{
+			desc:   "nest input with pointer and metadata",
+			args:   []string{"--data-field", "/context/request", "-m", "filename=five.json"},
+			expect: `{"context":{"request":{"user":"blue"}},"metadata":{"filename":"five.json"}}`,
+		},
+		{
+			desc:   "single level pointer works as plain key",
+			args:   []string{"--data-field", "/mydata"},
+			expect: `{"mydata":{"user":"blue"}}`,
+		},
+		{
+			desc:   "escaped slash and tilde in pointer",
+			args:   []string{"--data-field", "/a~1b/c~0d"},
+			expect: `{"a/b":{"c~d":{"user":"blue"}}}`,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					var input json.RawMessage
+					bindRequest(t, r.Body, &input)
+					assert.JSONEq(t, tC.expect, string(input))
 
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+			}, tC.args...)...))
+			require.NoError(t, err)
+			assert.Equal(t, 1, called)
+		})
+	}
 }
 
-func TestMetadata(t *testing.T) {
+func TestNoMetadataOnEmpty(t *testing.T) {
 	ctx := context.Background()
 
-	t.Run("inject metadata", func(t *testing.T) {
-		var called int
-		err := opaq.New(
-			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
-				called++
-				var input map[string]interface{}
+	testCases := []struct {
+		desc     string
+		input    string
+		args     []string
+		metadata bool
+	}{
+		{
+			desc:     "skip metadata with null input",
+			input:    `null`,
+			args:     []string{"--no-metadata-on-empty"},
+			metadata: false,
+		},
+		{
+			desc:     "skip metadata with empty object",
+			input:    `{}`,
+			args:     []string{"--no-metadata-on-empty"},
+			metadata: false,
+		},
+		{
+			desc:     "skip metadata with empty object and data field",
+			input:    `{}`,
+			args:     []string{"--no-metadata-on-empty", "--data-field", "mydata"},
+			metadata: false,
+		},
+		{
+			desc:     "inject metadata with non-empty object",
+			input:    `{"user":"blue"}`,
+			args:     []string{"--no-metadata-on-empty"},
+			metadata: true,
+		},
+		{
+			desc:     "inject metadata with empty object without option",
+			input:    `{}`,
+			metadata: true,
+		},
+	}
 
-				bindRequest(t, r.Body, &input)
-				assert.Equal(t, "blue", input["user"])
-				metadata, ok := input["metadata"].(map[string]interface{})
-				require.True(t, ok)
-				require.NotNil(t, metadata)
-				assert.Equal(t, "five.json", metadata["filename"])
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					var input map[string]interface{}
+					bindRequest(t, r.Body, &input)
+					_, ok := input["metadata"]
+					assert.Equal(t, tC.metadata, ok)
 
-				return &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &sampleResult{Allow: true}),
-				}, nil
-			}}),
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(bytes.NewReader([]byte(tC.input))),
+			).Cmd(ctx, args(append([]string{
+				"-u", "https://opa.example.com/xxx", // URL
+				"-m", "filename=five.json",
+			}, tC.args...)...))
+			require.NoError(t, err)
+			assert.Equal(t, 1, called)
+		})
+	}
+}
+
+func TestHTTPClient(t *testing.T) {
+	t.Run("default transport", func(t *testing.T) {
+		client := opaq.NewHTTPClient(0, 0)
+		transport, ok := client.Transport.(*http.Transport)
+		require.True(t, ok)
+		assert.Equal(t, http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost, transport.MaxIdleConnsPerHost)
+		assert.Equal(t, http.DefaultTransport.(*http.Transport).IdleConnTimeout, transport.IdleConnTimeout)
+	})
+
+	t.Run("tune keep-alive connections", func(t *testing.T) {
+		client := opaq.NewHTTPClient(32, time.Minute)
+		transport, ok := client.Transport.(*http.Transport)
+		require.True(t, ok)
+		assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+		assert.Equal(t, time.Minute, transport.IdleConnTimeout)
+	})
+
+	t.Run("options are applied to default client by command", func(t *testing.T) {
+		captured := opaq.CaptureHTTPClient(t)
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, err := io.Copy(w, toRespBody(t, &sampleResult{Allow: true}))
+			require.NoError(t, err)
+		}))
+		defer server.Close()
+
+		err := opaq.New(
 			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
-		).Cmd(ctx, args(
-			"-u", "https://opa.example.com/xxx", // URL
-			"-m", "filename=five.json",
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(context.Background(), args(
+			"-u", server.URL+"/v1/data/xxx", // URL
+			"--max-idle-conns", "32",
+			"--idle-timeout", "1m",
 		))
 		require.NoError(t, err)
-		assert.Equal(t, 1, called)
+
+		require.NotNil(t, captured())
+		transport, ok := captured().Transport.(*http.Transport)
+		require.True(t, ok)
+		assert.Equal(t, 32, transport.MaxIdleConnsPerHost)
+		assert.Equal(t, time.Minute, transport.IdleConnTimeout)
 	})
 
-	t.Run("change metadata field name", func(t *testing.T) {
+	t.Run("injected client is not modified by options", func(t *testing.T) {
+		captured := opaq.CaptureHTTPClient(t)
 		var called int
+		client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+			called++
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       toRespBody(t, &sampleResult{Allow: true}),
+			}, nil
+		})}
+
 		err := opaq.New(
-			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
-				called++
-				var input map[string]interface{}
+			opaq.WithHTTPClient(client),
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+		).Cmd(context.Background(), args(
+			"-u", "https://opa.example.com/v1/data/xxx", // URL
+			"--max-idle-conns", "32",
+			"--idle-timeout", "1m",
+			"--no-follow-redirects",
+		))
+		require.NoError(t, err)
+		assert.Equal(t, 1, called)
 
-				bindRequest(t, r.Body, &input)
+		// default client is not built and injected client keeps its settings
+		assert.Nil(t, captured())
+		assert.Nil(t, client.CheckRedirect)
+		_, ok := client.Transport.(roundTripFunc)
+		assert.True(t, ok)
+	})
+}
 
-				// not found by default name
-				_, ok := input["metadata"].(map[string]interface{})
-				assert.False(t, ok)
+type roundTripFunc func(r *http.Request) (*http.Response, error)
 
-				// found in specified field name
-				metadata, ok := input["metaverse"].(map[string]interface{})
-				require.True(t, ok)
-				require.NotNil(t, metadata)
-				assert.Equal(t, "five.json", metadata["filename"])
+func (x roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return x(r)
+}
 
-				return &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &sampleResult{Allow: true}),
-				}, nil
-			}}),
+func TestHTTP2(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc  string
+		args  []string
+		proto int
+	}{
+		{
+			desc:  "use h2c with http2 option",
+			args:  []string{"--http2"},
+			proto: 2,
+		},
+		{
+			desc:  "use HTTP/1.1 by default",
+			proto: 1,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called++
+				assert.Equal(t, tC.proto, r.ProtoMajor)
+				w.Header().Set("Content-Type", "application/json")
+				_, err := io.Copy(w, toRespBody(t, &sampleResult{Allow: true}))
+				require.NoError(t, err)
+			})
+			server := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+			defer server.Close()
+
+			err := opaq.New(
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(append([]string{
+				"-u", server.URL + "/v1/data/xxx", // URL
+			}, tC.args...)...))
+			require.NoError(t, err)
+			assert.Equal(t, 1, called)
+		})
+	}
+
+	t.Run("use h2c for discovered http URL", func(t *testing.T) {
+		var called int
+		server := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called++
+			assert.Equal(t, 2, r.ProtoMajor)
+			w.Header().Set("Content-Type", "application/json")
+			_, err := io.Copy(w, toRespBody(t, &sampleResult{Allow: true}))
+			require.NoError(t, err)
+		}), &http2.Server{}))
+		defer server.Close()
+
+		discovery := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			_, err := w.Write([]byte(`{"url":"` + server.URL + `/v1/data/xxx"}`))
+			require.NoError(t, err)
+		}), &http2.Server{}))
+		defer discovery.Close()
+
+		err := opaq.New(
 			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
 		).Cmd(ctx, args(
-			"-u", "https://opa.example.com/xxx", // URL
-			"-m", "filename=five.json",
-			"--metadata-field", "metaverse",
+			"--discover", discovery.URL,
+			"--http2",
+			"--idle-timeout", "30s",
 		))
 		require.NoError(t, err)
 		assert.Equal(t, 1, called)
 	})
+}
 
-	t.Run("change data path", func(t *testing.T) {
-		var called int
+func TestTiming(t *testing.T) {
+	ctx := context.Background()
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, err := io.Copy(w, toRespBody(t, &sampleResult{Allow: true}))
+		require.NoError(t, err)
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	t.Run("write timing to stderr", func(t *testing.T) {
+		var stdout, stderr bytes.Buffer
 		err := opaq.New(
-			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
-				called++
-				var input map[string]interface{}
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(&stdout),
+			opaq.WithStderr(&stderr),
+		).Cmd(ctx, args(
+			"-u", server.URL+"/v1/data/xxx", // URL
+			"--timing",
+		))
+		require.NoError(t, err)
 
-				bindRequest(t, r.Body, &input)
-				assert.Nil(t, input["user"])
-				data, ok := input["mydata"].(map[string]interface{})
-				require.True(t, ok)
-				assert.Equal(t, "blue", data["user"])
+		// result output is not changed
+		assert.Equal(t, "{\n  \"allow\": true\n}\n", stdout.String())
 
-				metadata, ok := input["metadata"].(map[string]interface{})
-				require.True(t, ok)
-				require.NotNil(t, metadata)
-				assert.Equal(t, "five.json", metadata["filename"])
+		require.True(t, strings.HasPrefix(stderr.String(), "http timing:\n"))
+		var timing map[string]string
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(stderr.String(), "http timing:\n")), &timing))
+		// no DNS lookup and TLS for http://127.0.0.1
+		assert.Contains(t, timing, "connect")
+		assert.Contains(t, timing, "first_byte")
+		assert.Contains(t, timing, "total")
+		assert.NotContains(t, timing, "tls")
+		for _, v := range timing {
+			_, err := time.ParseDuration(v)
+			assert.NoError(t, err)
+		}
+	})
 
-				return &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &sampleResult{Allow: true}),
-				}, nil
-			}}),
+	t.Run("record connect of h2c", func(t *testing.T) {
+		h2cServer := httptest.NewServer(h2c.NewHandler(handler, &http2.Server{}))
+		defer h2cServer.Close()
+
+		var stderr bytes.Buffer
+		err := opaq.New(
 			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+			opaq.WithStderr(&stderr),
 		).Cmd(ctx, args(
-			"-u", "https://opa.example.com/xxx", // URL
-			"-m", "filename=five.json",
-			"--data-field", "mydata",
+			"-u", h2cServer.URL+"/v1/data/xxx", // URL
+			"--timing",
+			"--http2",
 		))
 		require.NoError(t, err)
-		assert.Equal(t, 1, called)
+
+		var timing map[string]string
+		require.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(stderr.String(), "http timing:\n")), &timing))
+		assert.Contains(t, timing, "connect")
+		assert.Contains(t, timing, "first_byte")
+		assert.Contains(t, timing, "total")
 	})
 
-	t.Run("no metadata and set only data field name", func(t *testing.T) {
-		var called int
+	t.Run("no timing by default", func(t *testing.T) {
+		var stderr bytes.Buffer
 		err := opaq.New(
-			opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
-				called++
-				var input map[string]interface{}
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+			opaq.WithStderr(&stderr),
+		).Cmd(ctx, args(
+			"-u", server.URL+"/v1/data/xxx", // URL
+		))
+		require.NoError(t, err)
+		assert.Empty(t, stderr.String())
+	})
+}
 
-				bindRequest(t, r.Body, &input)
-				assert.Nil(t, input["user"])
-				data, ok := input["mydata"].(map[string]interface{})
-				require.True(t, ok)
-				assert.Equal(t, "blue", data["user"])
+func TestNoFollowRedirects(t *testing.T) {
+	ctx := context.Background()
 
-				_, ok = input["metadata"].(map[string]interface{})
-				require.False(t, ok)
+	var redirected int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/data/old", func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/v1/data/new", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/v1/data/new", func(w http.ResponseWriter, r *http.Request) {
+		redirected++
+		w.Header().Set("Content-Type", "application/json")
+		_, err := io.Copy(w, toRespBody(t, &sampleResult{Allow: true}))
+		require.NoError(t, err)
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
 
-				return &http.Response{
-					StatusCode: http.StatusOK,
-					Body:       toRespBody(t, &sampleResult{Allow: true}),
-				}, nil
-			}}),
+	t.Run("follow redirect by default", func(t *testing.T) {
+		redirected = 0
+		err := opaq.New(
 			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
 		).Cmd(ctx, args(
-			"-u", "https://opa.example.com/xxx", // URL
-			"--data-field", "mydata",
+			"-u", server.URL+"/v1/data/old", // URL
 		))
 		require.NoError(t, err)
-		assert.Equal(t, 1, called)
+		assert.Equal(t, 1, redirected)
+	})
+
+	t.Run("do not follow redirect with option", func(t *testing.T) {
+		redirected = 0
+		var stderr bytes.Buffer
+		err := opaq.New(
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+			opaq.WithStdout(ioutil.Discard),
+			opaq.WithStderr(&stderr),
+		).Cmd(ctx, args(
+			"-u", server.URL+"/v1/data/old", // URL
+			"--no-follow-redirects",
+		))
+		assert.ErrorIs(t, err, opaq.ErrUnexpectedStatus)
+		var goErr *goerr.Error
+		require.True(t, errors.As(err, &goErr))
+		assert.Equal(t, http.StatusTemporaryRedirect, goErr.Values()["code"])
+		assert.Equal(t, 0, redirected)
+		assert.Contains(t, stderr.String(), "/v1/data/new")
+	})
+}
+
+func writeTempFile(t *testing.T, data string) string {
+	tmp, err := ioutil.TempFile("", "")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.Remove(tmp.Name()) })
+
+	_, err = tmp.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, tmp.Close())
+	return tmp.Name()
+}
+
+func TestConfigFile(t *testing.T) {
+	ctx := context.Background()
+
+	yamlConfig := writeTempFile(t, `
+url: https://opa.example.com/from-file
+http-header:
+  - "X-Token: FromFile"
+metadata:
+  - filename=file.json
+metadata-field: meta
+`)
+	jsonConfig := writeTempFile(t, `{
+  "url": "https://opa.example.com/from-json",
+  "http-header": ["X-Token: FromJSON"]
+}`)
+
+	testCases := []struct {
+		desc     string
+		args     []string
+		url      string
+		token    string
+		metadata map[string]interface{}
+	}{
+		{
+			desc:     "load yaml config file",
+			args:     []string{"--config", yamlConfig},
+			url:      "https://opa.example.com/from-file",
+			token:    "FromFile",
+			metadata: map[string]interface{}{"filename": "file.json"},
+		},
+		{
+			desc:  "load json config file",
+			args:  []string{"--config", jsonConfig},
+			url:   "https://opa.example.com/from-json",
+			token: "FromJSON",
+		},
+		{
+			desc:     "command line options have priority over config file",
+			args:     []string{"--config", yamlConfig, "-u", "https://opa.example.com/from-arg", "-H", "X-Token: FromArg"},
+			url:      "https://opa.example.com/from-arg",
+			token:    "FromArg",
+			metadata: map[string]interface{}{"filename": "file.json"},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					assert.Equal(t, tC.url, r.URL.String())
+					assert.Equal(t, tC.token, r.Header.Get("X-Token"))
+
+					var input map[string]interface{}
+					bindRequest(t, r.Body, &input)
+					if tC.metadata != nil {
+						assert.Equal(t, tC.metadata, input["meta"])
+					} else {
+						assert.NotContains(t, input, "meta")
+					}
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(tC.args...))
+			require.NoError(t, err)
+			assert.Equal(t, 1, called)
+		})
+	}
+
+	t.Run("unknown field in config file fails", func(t *testing.T) {
+		path := writeTempFile(t, `urll: https://opa.example.com`)
+		err := opaq.New().Cmd(ctx, args("--config", path))
+		assert.ErrorIs(t, err, opaq.ErrInvalidConfiguration)
+	})
+}
+
+func TestEnvConfig(t *testing.T) {
+	ctx := context.Background()
+
+	fileConfig := writeTempFile(t, `
+url: https://opa.example.com/from-file
+http-header:
+  - "X-Token: FromFile"
+`)
+
+	testCases := []struct {
+		desc     string
+		args     []string
+		url      string
+		token    string
+		metadata map[string]interface{}
+	}{
+		{
+			desc:     "load config from environment variable",
+			args:     []string{"--env-config", "OPAQ_TEST_ENV_CONFIG"},
+			url:      "https://opa.example.com/from-env",
+			token:    "FromEnv",
+			metadata: map[string]interface{}{"function": "lambda"},
+		},
+		{
+			desc:     "command line options have priority over env config",
+			args:     []string{"--env-config", "OPAQ_TEST_ENV_CONFIG", "-u", "https://opa.example.com/from-arg"},
+			url:      "https://opa.example.com/from-arg",
+			token:    "FromEnv",
+			metadata: map[string]interface{}{"function": "lambda"},
+		},
+		{
+			desc:     "env config has priority over config file",
+			args:     []string{"--env-config", "OPAQ_TEST_ENV_CONFIG", "--config", fileConfig},
+			url:      "https://opa.example.com/from-env",
+			token:    "FromEnv",
+			metadata: map[string]interface{}{"function": "lambda"},
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			t.Setenv("OPAQ_TEST_ENV_CONFIG", `{
+  "url": "https://opa.example.com/from-env",
+  "http-header": ["X-Token: FromEnv"],
+  "metadata": ["function=lambda"],
+  "format": "json"
+}`)
+
+			var called int
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					called++
+					assert.Equal(t, tC.url, r.URL.String())
+					assert.Equal(t, tC.token, r.Header.Get("X-Token"))
+
+					var input map[string]interface{}
+					bindRequest(t, r.Body, &input)
+					assert.Equal(t, tC.metadata, input["metadata"])
+
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       toRespBody(t, &sampleResult{Allow: true}),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+			).Cmd(ctx, args(tC.args...))
+			require.NoError(t, err)
+			assert.Equal(t, 1, called)
+		})
+	}
+
+	t.Run("unset environment variable fails", func(t *testing.T) {
+		err := opaq.New().Cmd(ctx, args("--env-config", "OPAQ_TEST_ENV_CONFIG_NOT_SET"))
+		assert.ErrorIs(t, err, opaq.ErrInvalidConfiguration)
+	})
+
+	t.Run("broken JSON fails", func(t *testing.T) {
+		t.Setenv("OPAQ_TEST_ENV_CONFIG", `{"url": `)
+		err := opaq.New().Cmd(ctx, args("--env-config", "OPAQ_TEST_ENV_CONFIG"))
+		assert.ErrorIs(t, err, opaq.ErrInvalidConfiguration)
+	})
+
+	t.Run("merged config is validated", func(t *testing.T) {
+		t.Setenv("OPAQ_TEST_ENV_CONFIG", `{"url": "https://opa.example.com", "format": "xml"}`)
+		err := opaq.New(
+			opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		).Cmd(ctx, args("--env-config", "OPAQ_TEST_ENV_CONFIG"))
+		assert.ErrorIs(t, err, opaq.ErrInvalidConfiguration)
 	})
 }
 
+func TestExpected(t *testing.T) {
+	ctx := context.Background()
+
+	jsonFile := writeTempFile(t, `{"allow": true, "reasons": ["a", "b"]}`)
+	yamlFile := writeTempFile(t, "allow: true\nreasons:\n  - a\n  - b\n")
+	require.NoError(t, os.Rename(yamlFile, yamlFile+".yml"))
+	yamlFile += ".yml"
+	t.Cleanup(func() { os.Remove(yamlFile) })
+	mismatchFile := writeTempFile(t, `{"allow": false, "reasons": ["a", "b"]}`)
+	lastLineFile := writeTempFile(t, `{"allow": true, "reasons": ["a", "b"], "zone": "x"}`)
+
+	testCases := []struct {
+		desc     string
+		expected string
+		diff     string
+	}{
+		{
+			desc:     "match with JSON file",
+			expected: jsonFile,
+		},
+		{
+			desc:     "match with YAML file",
+			expected: yamlFile,
+		},
+		{
+			desc:     "mismatch",
+			expected: mismatchFile,
+			diff: "--- " + mismatchFile + `
++++ result
+@@ -1,5 +1,5 @@
+ {
+-  "allow": false,
++  "allow": true,
+   "reasons": [
+     "a",
+     "b"
+`,
+		},
+		{
+			desc:     "mismatch at last line",
+			expected: lastLineFile,
+			diff: "--- " + lastLineFile + `
++++ result
+@@ -3,6 +3,5 @@
+   "reasons": [
+     "a",
+     "b"
+-  ],
+-  "zone": "x"
++  ]
+ }
+`,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stderr bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"result":{"reasons":["a","b"],"allow":true}}`))),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+				opaq.WithStderr(&stderr),
+			).Cmd(ctx, args(
+				"-u", "https://opa.example.com/v1/data/xxx", // URL
+				"--expected", tC.expected,
+			))
+
+			if tC.diff == "" {
+				require.NoError(t, err)
+				assert.Empty(t, stderr.String())
+			} else {
+				assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+				assert.Equal(t, tC.diff, stderr.String())
+			}
+		})
+	}
+}
+
+func TestExpectedLargeDocument(t *testing.T) {
+	// 20k lines differing near both ends must not need a table of all line pairs
+	values := make([]int, 20000)
+	for i := range values {
+		values[i] = i
+	}
+	expected, err := json.Marshal(values)
+	require.NoError(t, err)
+	values[0], values[len(values)-1] = -1, -1
+	result, err := json.Marshal(values)
+	require.NoError(t, err)
+
+	var stderr bytes.Buffer
+	err = opaq.New(
+		opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       ioutil.NopCloser(bytes.NewReader([]byte(`{"result":` + string(result) + `}`))),
+			}, nil
+		}}),
+		opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+		opaq.WithStdout(ioutil.Discard),
+		opaq.WithStderr(&stderr),
+	).Cmd(context.Background(), args(
+		"-u", "https://opa.example.com/v1/data/xxx", // URL
+		"--expected", writeTempFile(t, string(expected)),
+	))
+	assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+	assert.Equal(t, 2, strings.Count(stderr.String(), "@@ -"))
+	assert.Contains(t, stderr.String(), "-  0,\n+  -1,\n")
+	assert.Contains(t, stderr.String(), "-  19999\n+  -1\n")
+}
+
+func TestExpectedNumber(t *testing.T) {
+	ctx := context.Background()
+
+	testCases := []struct {
+		desc     string
+		result   string
+		expected string
+		match    bool
+	}{
+		{
+			desc:     "same large integer matches",
+			result:   `{"id":9007199254740993}`,
+			expected: `{"id": 9007199254740993}`,
+			match:    true,
+		},
+		{
+			desc:     "large integer differing only in last digit mismatches",
+			result:   `{"id":9007199254740993}`,
+			expected: `{"id": 9007199254740992}`,
+			match:    false,
+		},
+		{
+			desc:     "different number formats of same value match",
+			result:   `{"count":1000,"ratio":0.5}`,
+			expected: `{"count": 1e3, "ratio": 0.50}`,
+			match:    true,
+		},
+	}
+
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			var stderr bytes.Buffer
+			err := opaq.New(
+				opaq.WithHTTPClient(&stub{do: func(r *http.Request) (*http.Response, error) {
+					return &http.Response{
+						StatusCode: http.StatusOK,
+						Body:       ioutil.NopCloser(strings.NewReader(`{"result":` + tC.result + `}`)),
+					}, nil
+				}}),
+				opaq.WithStdin(toInput(t, sampleInput{User: "blue"})),
+				opaq.WithStdout(ioutil.Discard),
+				opaq.WithStderr(&stderr),
+			).Cmd(ctx, args(
+				"-u", "https://opa.example.com/v1/data/xxx", // URL
+				"--expected", writeTempFile(t, tC.expected),
+			))
+
+			if tC.match {
+				require.NoError(t, err)
+				assert.Empty(t, stderr.String())
+			} else {
+				assert.ErrorIs(t, err, opaq.ErrExitWithNonZero)
+				assert.Contains(t, stderr.String(), "-  \"id\": 9007199254740992")
+				assert.Contains(t, stderr.String(), "+  \"id\": 9007199254740993")
+			}
+		})
+	}
+}
+
 func TestInvalidOption(t *testing.T) {
 	testCases := []struct {
 		desc string
@@ -441,6 +2983,11 @@ func TestInvalidOption(t *testing.T) {
 			desc: "No URL must fail",
 			args: args(),
 		},
+		{
+			desc: "Invalid discovery URL must fail",
+			args: args("--discover", "invalid_url"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
 		{
 			desc: "Invalid URL must fail",
 			args: args("-u", "invalid_url"),
@@ -461,6 +3008,111 @@ func TestInvalidOption(t *testing.T) {
 			args: args("-u", "https://example.com", "-m", "foo=baa", "--metadata-field="),
 			err:  opaq.ErrInvalidConfiguration,
 		},
+		{
+			desc: "JSON pointer with empty key fails",
+			args: args("-u", "https://example.com", "--data-field", "/context//request"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "JSON pointer with invalid escape fails",
+			args: args("-u", "https://example.com", "--data-field", "/context/~2"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "NDJSON with GET method fails",
+			args: args("-u", "https://example.com", "--ndjson", "-X", "GET"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "NDJSON with server metrics fails",
+			args: args("-u", "https://example.com", "--ndjson", "--server-metrics"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Unknown output format fails",
+			args: args("-u", "https://example.com", "--output-format", "xml"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "SARIF output with passthrough fails",
+			args: args("-u", "https://example.com", "--output-format", "sarif", "--passthrough"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Negative max idle connections fails",
+			args: args("-u", "https://example.com", "--max-idle-conns", "-1"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Negative idle timeout fails",
+			args: args("-u", "https://example.com", "--idle-timeout", "-1s"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Echo input field conflicting with result fails",
+			args: args("-u", "https://example.com", "--echo-input", "--echo-input-field", "result"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Echo input with passthrough fails",
+			args: args("-u", "https://example.com", "--echo-input", "--passthrough"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Invalid HTTP method fails",
+			args: args("-u", "https://example.com", "-X", "PUT"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Negative max query length fails",
+			args: args("-u", "https://example.com", "--max-query-length", "-1"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Invalid API version fails",
+			args: args("-u", "https://example.com", "--api-version", "v2"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "v1 URL with v0 API fails",
+			args: args("-u", "https://example.com/v1/data/foo", "--api-version", "v0"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "v0 URL with v1 API fails",
+			args: args("-u", "https://example.com/v0/data/foo"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "GET method with v0 API fails",
+			args: args("-u", "https://example.com/v0/data/foo", "--api-version", "v0", "-X", "GET"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Server metrics with v0 API fails",
+			args: args("-u", "https://example.com/v0/data/foo", "--api-version", "v0", "--server-metrics"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Max idle conns with HTTP/2 fails",
+			args: args("-u", "https://example.com", "--http2", "--max-idle-conns", "10"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Invalid discover header fails",
+			args: args("--discover", "https://discovery.example.com/opa", "--discover-header", "X-Token"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Invalid sign key env fails",
+			args: args("-u", "https://example.com", "--sign-key-env", "MY-KEY"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
+		{
+			desc: "Invalid sign header fails",
+			args: args("-u", "https://example.com", "--sign-header", "invalid header"),
+			err:  opaq.ErrInvalidConfiguration,
+		},
 		{
 			desc: "Invalid data format",
 			args: args("-u", "https://example.com", "-f", "jsonnet"),
@@ -472,8 +3124,18 @@ func TestInvalidOption(t *testing.T) {
 			err := opaq.New().Cmd(context.Background(), tC.args)
 			assert.Error(t, err)
 			if tC.err != nil {
-				assert.ErrorIs(t, tC.err, err)
+				assert.ErrorIs(t, err, tC.err)
 			}
 		})
 	}
 }
+
+func TestInvalidFormat(t *testing.T) {
+	err := opaq.New().Cmd(context.Background(), args("-u", "https://example.com", "-f", "jsonnet"))
+	require.ErrorIs(t, err, opaq.ErrInvalidConfiguration)
+
+	// allowed formats are shown in stable order
+	var goErr *goerr.Error
+	require.True(t, errors.As(err, &goErr))
+	assert.Equal(t, "auto,csv,json,toml,yaml", goErr.Values()["allowed"])
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"io"
-	"net/http"
 	"os"
 
 	"github.com/m-mizutani/goerr"
@@ -19,15 +18,16 @@ type Proc struct {
 	httpClient HTTPClient
 	stdin      io.Reader
 	stdout     io.Writer
+	stderr     io.Writer
 }
 
 type Option func(proc *Proc)
 
 func New(options ...Option) *Proc {
 	proc := &Proc{
-		httpClient: &http.Client{},
-		stdin:      os.Stdin,
-		stdout:     os.Stdout,
+		stdin:  os.Stdin,
+		stdout: os.Stdout,
+		stderr: os.Stderr,
 	}
 	for _, opt := range options {
 		opt(proc)
@@ -38,9 +38,14 @@ func New(options ...Option) *Proc {
 type config struct {
 	queryConfig
 
-	headers  cli.StringSlice
-	metadata cli.StringSlice
-	LogLevel string
+	headers         cli.StringSlice
+	headerEnvs      cli.StringSlice
+	discoverHeaders cli.StringSlice
+	decodes         cli.StringSlice
+	metadata        cli.StringSlice
+	LogLevel        string
+	ConfigFile      string
+	EnvConfig       string
 }
 
 func (x *Proc) Cmd(ctx context.Context, args []string) error {
@@ -54,12 +59,14 @@ func (x *Proc) Cmd(ctx context.Context, args []string) error {
 			// Manage exit code
 			&cli.BoolFlag{
 				Name:        "fail-defined",
-				Usage:       "exits with non-zero exit code on undefined/empty result and errors",
+				Aliases:     []string{"fail-non-empty"},
+				Usage:       "exits with non-zero exit code on defined/non-empty result and errors",
 				Destination: &cfg.FailDefined,
 			},
 			&cli.BoolFlag{
 				Name:        "fail-undefined",
-				Usage:       "exits with non-zero exit code on defined/non-empty result and errors",
+				Aliases:     []string{"fail-empty"},
+				Usage:       "exits with non-zero exit code on undefined/empty result and errors",
 				Destination: &cfg.FailUndefined,
 			},
 
@@ -68,10 +75,27 @@ func (x *Proc) Cmd(ctx context.Context, args []string) error {
 				Name:        "url",
 				Aliases:     []string{"u"},
 				EnvVars:     []string{"OPAQ_URL"},
-				Required:    true,
-				Usage:       "Query URL of OPA server, e.g. https://opa.example.com/v1/data/foo",
+				Usage:       "Query URL of OPA server, e.g. https://opa.example.com/v1/data/foo (required if --discover is not set)",
 				Destination: &cfg.URL,
 			},
+			&cli.StringFlag{
+				Name:        "api-version",
+				EnvVars:     []string{"OPAQ_API_VERSION"},
+				Usage:       "version of OPA Data API [v0,v1]",
+				Value:       "v1",
+				Destination: &cfg.APIVersion,
+			},
+			&cli.StringFlag{
+				Name:        "discover",
+				EnvVars:     []string{"OPAQ_DISCOVER"},
+				Usage:       "Discovery URL returning query URL of OPA server, e.g. {\"url\": \"https://opa.example.com/v1/data/foo\"}. --url is used as fallback",
+				Destination: &cfg.Discover,
+			},
+			&cli.StringSliceFlag{
+				Name:        "discover-header",
+				Usage:       "Custom header(s) of discovery request. e.g. `X-Token: xxxxxxx`. --http-header and --header-env are not sent to discovery URL",
+				Destination: &cfg.discoverHeaders,
+			},
 
 			// In/Out
 			&cli.StringFlag{
@@ -88,13 +112,66 @@ func (x *Proc) Cmd(ctx context.Context, args []string) error {
 				Value:       "-",
 				Destination: &cfg.Output,
 			},
+			&cli.StringFlag{
+				Name:        "output-format",
+				Usage:       "output format [json,sarif], sarif converts deny/violation/warn messages to SARIF results",
+				Value:       "json",
+				Destination: &cfg.OutputFormat,
+			},
+			&cli.BoolFlag{
+				Name:        "single",
+				Usage:       "require exactly one input document",
+				Destination: &cfg.Single,
+			},
+			&cli.BoolFlag{
+				Name:        "passthrough",
+				Usage:       "write raw result JSON of OPA server verbatim without re-encoding",
+				Destination: &cfg.Passthrough,
+			},
+			&cli.BoolFlag{
+				Name:        "no-html-escape",
+				Usage:       "do not escape <, > and & in output JSON",
+				Destination: &cfg.NoHTMLEscape,
+			},
+			&cli.StringFlag{
+				Name:        "expected",
+				Aliases:     []string{"e"},
+				Usage:       "expected result file (JSON or YAML), exits with non-zero and shows diff if result does not match",
+				Destination: &cfg.Expected,
+			},
+			&cli.BoolFlag{
+				Name:        "echo-input",
+				Usage:       "embed input data alongside result in output",
+				Destination: &cfg.EchoInput,
+			},
+			&cli.StringFlag{
+				Name:        "echo-input-field",
+				Usage:       "field name of input data embedded by --echo-input",
+				Value:       "input",
+				Destination: &cfg.EchoInputField,
+			},
 			&cli.StringFlag{
 				Name:        "format",
 				Aliases:     []string{"f"},
-				Usage:       "input format [json,yaml]",
-				Value:       "json",
+				Usage:       "input format [auto,json,yaml,toml,csv], auto detects format by file extension or content",
+				Value:       "auto",
 				Destination: &cfg.Format,
 			},
+			&cli.Int64Flag{
+				Name:        "max-input-bytes",
+				Usage:       "max size of input in bytes, 0 means unlimited",
+				Destination: &cfg.MaxInputBytes,
+			},
+			&cli.StringSliceFlag{
+				Name:        "decode-base64",
+				Usage:       "JSON pointer of a field of base64 encoded JSON to decode before query, e.g. /event/payload or /records/0/payload",
+				Destination: &cfg.decodes,
+			},
+			&cli.BoolFlag{
+				Name:        "csv-no-header",
+				Usage:       "use positional index as key of CSV column instead of header row",
+				Destination: &cfg.CSVNoHeader,
+			},
 
 			// Metadata
 			&cli.StringSliceFlag{
@@ -111,6 +188,11 @@ func (x *Proc) Cmd(ctx context.Context, args []string) error {
 				Value:       "metadata",
 				Destination: &cfg.MetaDataField,
 			},
+			&cli.BoolFlag{
+				Name:        "no-metadata-on-empty",
+				Usage:       "skip metadata injection if input is empty (no document, null or empty object)",
+				Destination: &cfg.NoMetadataOnEmpty,
+			},
 			&cli.StringFlag{
 				Name:        "data-field",
 				EnvVars:     []string{"OPAQ_DATA_FIELD"},
@@ -119,6 +201,39 @@ func (x *Proc) Cmd(ctx context.Context, args []string) error {
 			},
 
 			// Customize HTTP request
+			&cli.StringFlag{
+				Name:        "method",
+				Aliases:     []string{"X"},
+				Usage:       "HTTP method [POST,GET], input is sent as query parameter with GET",
+				Value:       "POST",
+				Destination: &cfg.Method,
+			},
+			&cli.BoolFlag{
+				Name:        "timing",
+				Usage:       "write DNS, connect, TLS, first byte and total durations of HTTP request to stderr",
+				Destination: &cfg.Timing,
+			},
+			&cli.BoolFlag{
+				Name:        "ndjson",
+				Usage:       "send each input document as a line of application/x-ndjson in a single request, server must respond NDJSON",
+				Destination: &cfg.NDJSON,
+			},
+			&cli.BoolFlag{
+				Name:        "server-metrics",
+				Usage:       "request server-side evaluation metrics (metrics=true) and write them to stderr",
+				Destination: &cfg.ServerMetrics,
+			},
+			&cli.BoolFlag{
+				Name:        "server-pretty",
+				Usage:       "request human readable response (pretty=true) to OPA server",
+				Destination: &cfg.ServerPretty,
+			},
+			&cli.IntFlag{
+				Name:        "max-query-length",
+				Usage:       "max length of encoded input query parameter with GET method, POST is used if exceeded",
+				Value:       2048,
+				Destination: &cfg.MaxQueryLength,
+			},
 			&cli.StringSliceFlag{
 				Name:        "http-header",
 				Aliases:     []string{"H"},
@@ -126,8 +241,65 @@ func (x *Proc) Cmd(ctx context.Context, args []string) error {
 				Usage:       "Custom header(s) of a HTTP request. e.g. `X-Token: xxxxxxx`",
 				Destination: &cfg.headers,
 			},
+			&cli.StringSliceFlag{
+				Name:        "header-env",
+				Usage:       "Custom header(s) with value read from environment variable to keep secret out of argv. e.g. `X-Token=TOKEN_VAR`",
+				Destination: &cfg.headerEnvs,
+			},
+			&cli.BoolFlag{
+				Name:        "allow-protected-headers",
+				Usage:       "allow to set protected headers (Content-Type, Host, etc.) by --http-header, Host overrides host of request",
+				Destination: &cfg.AllowProtectedHeaders,
+			},
+			&cli.StringFlag{
+				Name:        "sign-key-env",
+				Usage:       "name of environment variable containing key of HMAC-SHA256 signature of request body, the key is never taken from argv",
+				Value:       "OPAQ_SIGN_KEY",
+				Destination: &cfg.SignKeyEnv,
+			},
+			&cli.StringFlag{
+				Name:        "sign-header",
+				EnvVars:     []string{"OPAQ_SIGN_HEADER"},
+				Usage:       "header name of HMAC-SHA256 signature",
+				Value:       "X-Signature",
+				Destination: &cfg.SignHeader,
+			},
+
+			// Customize HTTP transport
+			&cli.IntFlag{
+				Name:        "max-idle-conns",
+				Usage:       "max idle (keep-alive) connections per host, 0 is default of Go. Not available with --http2",
+				Destination: &cfg.MaxIdleConns,
+			},
+			&cli.DurationFlag{
+				Name:        "idle-timeout",
+				Usage:       "timeout of idle (keep-alive) connection, 0 is default of Go",
+				Destination: &cfg.IdleTimeout,
+			},
+			&cli.BoolFlag{
+				Name:        "http2",
+				Usage:       "force HTTP/2, h2c (HTTP/2 cleartext) is used for http URL",
+				Destination: &cfg.HTTP2,
+			},
+			&cli.BoolFlag{
+				Name:        "no-follow-redirects",
+				Usage:       "do not follow 3xx redirect and fail with the status code",
+				Destination: &cfg.NoFollowRedirects,
+			},
 
 			// misc
+			&cli.StringFlag{
+				Name:        "config",
+				Aliases:     []string{"c"},
+				EnvVars:     []string{"OPAQ_CONFIG"},
+				Usage:       "config file (YAML or JSON), options in command line have priority over the file",
+				Destination: &cfg.ConfigFile,
+			},
+			&cli.StringFlag{
+				Name:        "env-config",
+				Usage:       "name of environment variable containing config in the same schema as config file, it has priority over --config",
+				Destination: &cfg.EnvConfig,
+			},
 			&cli.StringFlag{
 				Name:        "log-level",
 				Aliases:     []string{"l"},
@@ -137,13 +309,34 @@ func (x *Proc) Cmd(ctx context.Context, args []string) error {
 			},
 		},
 
-		Before: func(_ *cli.Context) error {
+		Before: func(c *cli.Context) error {
 			cfg.Headers = cfg.headers.Value()
+			cfg.HeaderEnvs = cfg.headerEnvs.Value()
+			cfg.DiscoverHeaders = cfg.discoverHeaders.Value()
+			cfg.DecodeBase64 = cfg.decodes.Value()
 			cfg.MetaData = cfg.metadata.Value()
 
+			if cfg.ConfigFile != "" {
+				file, err := loadConfigFile(cfg.ConfigFile)
+				if err != nil {
+					return err
+				}
+				file.apply(c, &cfg)
+			}
+			// applied after config file to overwrite it
+			if cfg.EnvConfig != "" {
+				env, err := loadEnvConfig(cfg.EnvConfig)
+				if err != nil {
+					return err
+				}
+				env.apply(c, &cfg)
+			}
+
 			l, err := zlog.NewWithError(
 				zlog.WithLogLevel(cfg.LogLevel),
 				zlog.WithFilters(filter.Tag()),
+				// stdout is reserved for result
+				zlog.WithEmitter(zlog.NewWriterWith(zlog.NewConsoleFormatter(), x.stderr)),
 			)
 			if err != nil {
 				return err
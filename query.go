@@ -1,16 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
+	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/BurntSushi/toml"
 	validation "github.com/go-ozzo/ozzo-validation/v4"
 	"github.com/go-ozzo/ozzo-validation/v4/is"
 	"github.com/m-mizutani/goerr"
@@ -19,41 +30,145 @@ import (
 
 type queryConfig struct {
 	URL           string
+	Discover      string
 	FailDefined   bool
 	FailUndefined bool
 	Input         string
+	Single        bool
 	Output        string
+	Expected      string
+	NoHTMLEscape  bool
+	OutputFormat  string
 	Format        string
+	CSVNoHeader   bool
+	MaxInputBytes int64
+	DecodeBase64  []string
 
-	Headers       []string
-	MetaData      []string
-	MetaDataField string
-	DataField     string
+	Method         string
+	MaxQueryLength int
+	ServerMetrics  bool
+	ServerPretty   bool
+	APIVersion     string
+	NDJSON         bool
+	Timing         bool
+
+	Headers               []string
+	HeaderEnvs            []string
+	DiscoverHeaders       []string // sent to --discover instead of Headers and HeaderEnvs
+	AllowProtectedHeaders bool
+	SignKeyEnv            string
+	SignHeader            string
+	MetaData              []string
+	MetaDataField         string
+	DataField             string
+
+	NoMetadataOnEmpty bool
+	Passthrough       bool
+	EchoInput         bool
+	EchoInputField    string
+
+	MaxIdleConns      int
+	IdleTimeout       time.Duration
+	HTTP2             bool
+	NoFollowRedirects bool
 }
 
 func (x *queryConfig) Validate() error {
+	// --url is used as fallback if --discover is set
 	if err := validation.Validate(x.URL,
-		validation.Required,
+		validation.When(x.Discover == "", validation.Required),
 		is.URL,
 	); err != nil {
 		return ErrInvalidConfiguration.Wrap(err).With("target", "--url")
 	}
+	if err := validation.Validate(x.Discover, is.URL); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--discover")
+	}
 
+	formats := inputFormats()
+	allowed := make([]interface{}, len(formats))
+	for i, format := range formats {
+		allowed[i] = format
+	}
 	if err := validation.Validate(x.Format,
 		validation.Required,
-		validation.In("json", "yaml"),
+		validation.In(allowed...),
 	); err != nil {
-		return ErrInvalidConfiguration.Wrap(err).With("target", "--format")
+		return ErrInvalidConfiguration.Wrap(err).
+			With("allowed", strings.Join(formats, ",")).
+			With("target", "--format")
+	}
+
+	if err := validation.Validate(x.Method,
+		validation.Required,
+		validation.In(http.MethodPost, http.MethodGet),
+	); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--method")
+	}
+	if err := validation.Validate(x.APIVersion,
+		validation.Required,
+		validation.In(APIVersionV0, APIVersionV1),
+	); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--api-version")
+	}
+	if x.APIVersion == APIVersionV0 && x.Method != http.MethodPost {
+		return goerr.Wrap(ErrInvalidConfiguration, "v0 API supports only POST method").With("target", "--method")
+	}
+	// v0 API responds result document only, without metrics
+	if x.APIVersion == APIVersionV0 && x.ServerMetrics {
+		return goerr.Wrap(ErrInvalidConfiguration, "v0 API does not support --server-metrics").With("target", "--server-metrics")
+	}
+	if err := validateAPIPath(x.URL, x.APIVersion, "--url"); err != nil {
+		return err
+	}
+
+	if err := validation.Validate(x.MaxQueryLength, validation.Min(0)); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--max-query-length")
+	}
+	if err := validation.Validate(x.MaxInputBytes, validation.Min(int64(0))); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--max-input-bytes")
 	}
 
 	for _, hdr := range x.Headers {
+		if err := x.validateHeader(hdr, "--header"); err != nil {
+			return err
+		}
+	}
+	for _, hdr := range x.DiscoverHeaders {
+		if err := x.validateHeader(hdr, "--discover-header"); err != nil {
+			return err
+		}
+	}
+
+	for _, hdr := range x.HeaderEnvs {
 		if err := validation.Validate(hdr,
 			validation.Required,
-			validation.Match(regexp.MustCompile(`^[\w-]+:.+$`)),
+			validation.Match(regexp.MustCompile(`^[\w-]+=\w+$`)),
 		); err != nil {
 			return ErrInvalidConfiguration.Wrap(err).
-				With("NOTE: Expected format", "HeaderName: Value").
-				With("target", "--header")
+				With("NOTE: Expected format", "HeaderName=ENV_VAR_NAME").
+				With("target", "--header-env")
+		}
+
+		if name, _ := parseHeaderEnv(hdr); !x.AllowProtectedHeaders && isProtectedHeader(name) {
+			return goerr.Wrap(ErrInvalidConfiguration, "protected header can not be set").
+				With("header", name).
+				With("NOTE", "use --allow-protected-headers to override it").
+				With("target", "--header-env")
+		}
+	}
+
+	if err := validation.Validate(x.SignKeyEnv,
+		validation.Match(regexp.MustCompile(`^\w+$`)),
+	); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--sign-key-env")
+	}
+	if x.SignKeyEnv != "" {
+		if err := validation.Validate(x.SignHeader,
+			validation.Required,
+			validation.Match(regexp.MustCompile(`^[\w-]+$`)),
+		); err != nil {
+			return ErrInvalidConfiguration.Wrap(err).With("target", "--sign-header")
 		}
 	}
 
@@ -76,18 +191,269 @@ func (x *queryConfig) Validate() error {
 		}
 	}
 
+	if _, err := parseDataField(x.DataField); err != nil {
+		return err
+	}
+	for _, pointer := range x.DecodeBase64 {
+		if _, err := parseJSONPointer(pointer, "--decode-base64"); err != nil {
+			return err
+		}
+	}
+
+	if x.NDJSON {
+		if x.Method != http.MethodPost || x.APIVersion != APIVersionV1 {
+			return goerr.Wrap(ErrInvalidConfiguration, "--ndjson requires POST method and v1 API")
+		}
+		if x.ServerMetrics {
+			return goerr.Wrap(ErrInvalidConfiguration, "--ndjson can not be used with --server-metrics")
+		}
+	}
+
+	if err := validation.Validate(x.OutputFormat,
+		validation.Required,
+		validation.In(outputFormatJSON, outputFormatSARIF),
+	); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--output-format")
+	}
+	if x.OutputFormat != outputFormatJSON && (x.Passthrough || x.EchoInput) {
+		return goerr.Wrap(ErrInvalidConfiguration, "--output-format can not be used with --passthrough and --echo-input")
+	}
+
+	if x.EchoInput {
+		if err := validation.Validate(x.EchoInputField,
+			validation.Required,
+			validation.NotIn("result"),
+		); err != nil {
+			return ErrInvalidConfiguration.Wrap(err).With("target", "--echo-input-field")
+		}
+		if x.Passthrough {
+			return goerr.Wrap(ErrInvalidConfiguration, "--echo-input can not be used with --passthrough")
+		}
+	}
+
+	if err := validation.Validate(x.MaxIdleConns, validation.Min(0)); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--max-idle-conns")
+	}
+	if err := validation.Validate(x.IdleTimeout, validation.Min(time.Duration(0))); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", "--idle-timeout")
+	}
+	// HTTP/2 multiplexes requests on a connection per host, so there is no pool size to tune
+	if x.HTTP2 && x.MaxIdleConns > 0 {
+		return goerr.Wrap(ErrInvalidConfiguration, "--max-idle-conns can not be used with --http2").With("target", "--max-idle-conns")
+	}
+
 	return nil
 }
 
-func (x *Proc) query(ctx context.Context, cfg *queryConfig) error {
-	logger.With("config", cfg).Debug("Starting inquiry")
+func (x *queryConfig) validateHeader(hdr, target string) error {
+	if err := validation.Validate(hdr,
+		validation.Required,
+		validation.Match(regexp.MustCompile(`^[\w-]+:.+$`)),
+	); err != nil {
+		return ErrInvalidConfiguration.Wrap(err).
+			With("NOTE: Expected format", "HeaderName: Value").
+			With("target", target)
+	}
 
-	if err := cfg.Validate(); err != nil {
-		return err
+	if name, _ := parseHeader(hdr); !x.AllowProtectedHeaders && isProtectedHeader(name) {
+		return goerr.Wrap(ErrInvalidConfiguration, "protected header can not be set").
+			With("header", name).
+			With("NOTE", "use --allow-protected-headers to override it").
+			With("target", target)
 	}
+	return nil
+}
+
+// protectedHeaders can not be set by --http-header because they break content negotiation or routing of HTTP request
+var protectedHeaders = []string{
+	"Connection",
+	"Content-Length",
+	"Content-Type",
+	"Host",
+	"Transfer-Encoding",
+}
+
+func isProtectedHeader(name string) bool {
+	for _, hdr := range protectedHeaders {
+		if strings.EqualFold(hdr, name) {
+			return true
+		}
+	}
+	return false
+}
 
-	inputData, err := x.readData(cfg.Input, cfg.Format)
+// parseHeader splits "HeaderName: Value" format. Value can contain colon, e.g. URL.
+func parseHeader(hdr string) (string, string) {
+	h := strings.SplitN(hdr, ":", 2)
+	if len(h) != 2 {
+		panic("validation does not work for header")
+	}
+	return strings.TrimSpace(h[0]), strings.TrimSpace(h[1])
+}
+
+// parseHeaderEnv splits "HeaderName=ENV_VAR_NAME" format of --header-env.
+func parseHeaderEnv(hdr string) (string, string) {
+	h := strings.SplitN(hdr, "=", 2)
+	if len(h) != 2 {
+		panic("validation does not work for header-env")
+	}
+	return h[0], h[1]
+}
+
+// dataAPIHint returns false with an example of correct URL if path of queryURL contains neither /v1/data nor /v0/data.
+func dataAPIHint(queryURL, version string) (string, bool) {
+	u, err := url.Parse(queryURL)
 	if err != nil {
+		return "", true // already validated
+	}
+	if strings.Contains(u.Path, "/"+APIVersionV1+"/data") || strings.Contains(u.Path, "/"+APIVersionV0+"/data") {
+		return "", true
+	}
+
+	return fmt.Sprintf("%s://%s/%s/data/{package path}", u.Scheme, u.Host, version), false
+}
+
+// validateAPIPath checks URL path is not for another version of Data API. Path for custom gateway is allowed.
+func validateAPIPath(queryURL, version, target string) error {
+	u, err := url.Parse(queryURL)
+	if err != nil {
+		return ErrInvalidConfiguration.Wrap(err).With("target", target)
+	}
+
+	another := APIVersionV0
+	if version == APIVersionV0 {
+		another = APIVersionV1
+	}
+	if strings.HasPrefix(u.Path, "/"+another+"/data") {
+		return goerr.Wrap(ErrInvalidConfiguration, "URL path does not match with API version").
+			With("url", queryURL).
+			With("api-version", version).
+			With("target", "--api-version")
+	}
+
+	return nil
+}
+
+// parseDataField splits --data-field into keys of nested objects. A value starting with "/" is parsed as JSON pointer (RFC 6901) such as /context/request, and other value is used as a single top-level key.
+func parseDataField(field string) ([]string, error) {
+	if field == "" {
+		return nil, nil
+	}
+	if !strings.HasPrefix(field, "/") {
+		return []string{field}, nil
+	}
+
+	return parseJSONPointer(field, "--data-field")
+}
+
+// parseJSONPointer splits JSON pointer (RFC 6901) into unescaped keys. target is an option name for error message. Empty key is not allowed.
+func parseJSONPointer(pointer, target string) ([]string, error) {
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, goerr.Wrap(ErrInvalidConfiguration, "JSON pointer must start with /").
+			With("pointer", pointer).
+			With("target", target)
+	}
+
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		if token == "" {
+			return nil, goerr.Wrap(ErrInvalidConfiguration, "empty key in JSON pointer").
+				With("pointer", pointer).
+				With("target", target)
+		}
+		// "~" must be escaped as "~0" and "/" as "~1"
+		if strings.Contains(strings.NewReplacer("~0", "", "~1", "").Replace(token), "~") {
+			return nil, goerr.Wrap(ErrInvalidConfiguration, "invalid escape in JSON pointer").
+				With("pointer", pointer).
+				With("target", target)
+		}
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(token)
+	}
+
+	return tokens, nil
+}
+
+// decodeBase64Field replaces base64 encoded JSON string at keys of doc with the decoded document. Both standard and URL-safe encoding are accepted.
+func decodeBase64Field(doc interface{}, keys []string, pointer string) error {
+	node := doc
+	for _, key := range keys[:len(keys)-1] {
+		child, ok := jsonChild(node, key)
+		if !ok {
+			return goerr.Wrap(ErrInvalidInput, "field of --decode-base64 is not found").With("pointer", pointer)
+		}
+		node = child
+	}
+
+	last := keys[len(keys)-1]
+	value, ok := jsonChild(node, last)
+	if !ok {
+		return goerr.Wrap(ErrInvalidInput, "field of --decode-base64 is not found").With("pointer", pointer)
+	}
+	encoded, ok := value.(string)
+	if !ok {
+		return goerr.Wrap(ErrInvalidInput, "field of --decode-base64 is not string").With("pointer", pointer)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		if raw, err = base64.URLEncoding.DecodeString(encoded); err != nil {
+			return ErrInvalidInput.Wrap(err).With("pointer", pointer)
+		}
+	}
+
+	var decoded interface{}
+	if err := decodeJSON(raw, &decoded); err != nil {
+		return ErrInvalidInput.Wrap(err).With("pointer", pointer).With("decoded", string(raw))
+	}
+
+	switch parent := node.(type) {
+	case map[string]interface{}:
+		parent[last] = decoded
+	case []interface{}:
+		idx, _ := arrayIndex(last, len(parent))
+		parent[idx] = decoded
+	}
+
+	return nil
+}
+
+// jsonChild returns a child of node referred by a token of JSON pointer. The token is a key of object or an index of array.
+func jsonChild(node interface{}, token string) (interface{}, bool) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		child, ok := v[token]
+		return child, ok
+	case []interface{}:
+		idx, ok := arrayIndex(token, len(v))
+		if !ok {
+			return nil, false
+		}
+		return v[idx], true
+	}
+	return nil, false
+}
+
+// arrayIndex parses token as an index of array of length. Index must be decimal digits without leading zero as RFC 6901 requires.
+func arrayIndex(token string, length int) (int, bool) {
+	if token == "" || (len(token) > 1 && token[0] == '0') {
+		return 0, false
+	}
+	for _, c := range token {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+	}
+	idx, err := strconv.Atoi(token)
+	if err != nil || idx >= length {
+		return 0, false
+	}
+	return idx, true
+}
+
+func (x *Proc) query(ctx context.Context, cfg *queryConfig) error {
+	logger.With("config", cfg).Debug("Starting inquiry")
+
+	if err := cfg.Validate(); err != nil {
 		return err
 	}
 
@@ -105,60 +471,220 @@ func (x *Proc) query(ctx context.Context, cfg *queryConfig) error {
 		}
 	}
 
+	dataKeys, err := parseDataField(cfg.DataField)
+	if err != nil {
+		return err
+	}
+
 	var data interface{}
-	if cfg.DataField == "" {
-		if metadata != nil {
-			root, ok := inputData.(map[string]interface{})
-			if !ok {
-				return goerr.Wrap(ErrInvalidConfiguration, "metadata can be injected to only object (key-value) type data")
-			}
-			root[cfg.MetaDataField] = metadata
+	if cfg.NDJSON {
+		docs, err := x.readDocuments(cfg)
+		if err != nil {
+			return err
 		}
 
-		data = inputData
+		// metadata and data field are applied to each document
+		list := make([]interface{}, len(docs))
+		for i, doc := range docs {
+			if list[i], err = wrapData(cfg, doc, metadata, dataKeys); err != nil {
+				return err
+			}
+		}
+		data = list
 	} else {
-		root := make(map[string]interface{})
-		root[cfg.DataField] = inputData
-		if metadata != nil {
-			root[cfg.MetaDataField] = metadata
+		inputData, err := x.readData(cfg)
+		if err != nil {
+			return err
+		}
+		if data, err = wrapData(cfg, inputData, metadata, dataKeys); err != nil {
+			return err
 		}
-		data = root
 	}
 
 	input := &QueryInput{
-		URL:     cfg.URL,
-		Data:    data,
-		Headers: make(http.Header),
+		URL:            cfg.URL,
+		Data:           data,
+		Headers:        make(http.Header),
+		Method:         cfg.Method,
+		MaxQueryLength: cfg.MaxQueryLength,
+		Metrics:        cfg.ServerMetrics,
+		Pretty:         cfg.ServerPretty,
+		APIVersion:     cfg.APIVersion,
+		NDJSON:         cfg.NDJSON,
+		SignKey:        []byte(os.Getenv(cfg.SignKeyEnv)), // read from env only to keep secret out of argv
+		SignHeader:     cfg.SignHeader,
 	}
 
 	for _, hdr := range cfg.Headers {
-		h := strings.Split(hdr, ":")
-		input.Headers.Add(strings.TrimSpace(h[0]), strings.TrimSpace(h[1]))
+		input.Headers.Add(parseHeader(hdr))
+	}
+	// value is read at request time to keep secret out of argv and shell history
+	for _, hdr := range cfg.HeaderEnvs {
+		name, envName := parseHeaderEnv(hdr)
+		value, ok := os.LookupEnv(envName)
+		if !ok {
+			return goerr.Wrap(ErrInvalidConfiguration, "environment variable for header is not set").
+				With("header", name).
+				With("env", envName).
+				With("target", "--header-env")
+		}
+		input.Headers.Add(name, value)
 	}
 
-	var out interface{}
-	client := Client{httpClient: x.httpClient}
-	if err := client.Query(ctx, input, &out); err != nil {
+	// HTTP transport options are applied only to default HTTP client
+	httpClient := x.httpClient
+	if httpClient == nil {
+		httpClient = defaultHTTPClient(cfg)
+	}
+
+	client := Client{
+		httpClient: httpClient,
+	}
+	if cfg.Discover != "" {
+		discoverHeaders := make(http.Header)
+		for _, hdr := range cfg.DiscoverHeaders {
+			discoverHeaders.Add(parseHeader(hdr))
+		}
+
+		discovered, err := client.Discover(ctx, cfg.Discover, discoverHeaders)
+		if err == nil {
+			err = validateAPIPath(discovered, cfg.APIVersion, "--discover")
+		}
+		if err != nil {
+			if cfg.URL == "" {
+				return err
+			}
+			logger.Err(err).With("url", cfg.URL).Warn("discovery failed, fall back to --url")
+		} else {
+			logger.With("url", discovered).Debug("discovered query URL")
+			input.URL = discovered
+		}
+	}
+
+	// not an error to allow custom gateway, but root URL of OPA server is a common mistake
+	if hint, ok := dataAPIHint(input.URL, cfg.APIVersion); !ok {
+		logger.With("url", input.URL).With("expected", hint).Warn("URL path does not look like Data API, OPA server may respond 404")
+	}
+
+	var raw json.RawMessage
+	queryCtx := ctx
+	var timing requestTiming
+	if cfg.Timing {
+		queryCtx = timing.withTrace(ctx)
+	}
+	timing.start = time.Now()
+	metrics, err := client.Query(queryCtx, input, &raw)
+	timing.done = time.Now()
+	if err != nil {
 		return err
 	}
 
-	if err := x.writeData(cfg.Output, out); err != nil {
+	var out interface{}
+	if err := decodeJSON(raw, &out); err != nil {
+		return ErrUnexpectedResp.Wrap(err).With("result", string(raw))
+	}
+
+	var output interface{} = formatOutput(cfg.OutputFormat, out, metadata)
+	if cfg.Passthrough {
+		output = raw
+	}
+	if cfg.EchoInput {
+		output = map[string]interface{}{
+			cfg.EchoInputField: data,
+			"result":           out,
+		}
+	}
+
+	if err := x.writeData(cfg, output); err != nil {
 		return err
 	}
 
+	if cfg.ServerMetrics {
+		if err := x.writeMetrics(metrics); err != nil {
+			return err
+		}
+	}
+	if cfg.Timing {
+		if err := x.writeTiming(&timing); err != nil {
+			return err
+		}
+	}
+
+	if cfg.Expected != "" {
+		if err := x.compareResult(cfg.Expected, out); err != nil {
+			return err
+		}
+	}
+
 	logger.Debug("Exiting inquiry")
 
-	if cfg.FailDefined && !isEmpty(out) {
-		return ErrExitWithNonZero
+	// each result of NDJSON response is checked individually
+	results := []interface{}{out}
+	if cfg.NDJSON {
+		results, _ = out.([]interface{})
 	}
-	if cfg.FailUndefined && isEmpty(out) {
-		return ErrExitWithNonZero
+	for _, result := range results {
+		if cfg.FailDefined && !isEmpty(result) {
+			return ErrExitWithNonZero
+		}
+		if cfg.FailUndefined && isEmpty(result) {
+			return ErrExitWithNonZero
+		}
 	}
 
 	return nil
 }
 
-func (x *Proc) readData(input string, format string) (interface{}, error) {
+// wrapData nests inputData by --data-field and injects metadata.
+func wrapData(cfg *queryConfig, inputData interface{}, metadata map[string]string, dataKeys []string) (interface{}, error) {
+	if cfg.NoMetadataOnEmpty && isEmptyInput(inputData) {
+		logger.Debug("skip metadata injection because of empty input")
+		metadata = nil
+	}
+
+	if len(dataKeys) == 0 {
+		if metadata != nil {
+			root, ok := inputData.(map[string]interface{})
+			if !ok {
+				return nil, goerr.Wrap(ErrInvalidConfiguration, "metadata can be injected to only object (key-value) type data")
+			}
+			root[cfg.MetaDataField] = metadata
+		}
+
+		return inputData, nil
+	}
+
+	root := make(map[string]interface{})
+	node := root
+	for _, key := range dataKeys[:len(dataKeys)-1] {
+		child := make(map[string]interface{})
+		node[key] = child
+		node = child
+	}
+	node[dataKeys[len(dataKeys)-1]] = inputData
+
+	if metadata != nil {
+		root[cfg.MetaDataField] = metadata
+	}
+	return root, nil
+}
+
+func (x *Proc) readData(cfg *queryConfig) (interface{}, error) {
+	results, err := x.readDocuments(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results) == 1 {
+		return results[0], nil
+	}
+
+	return results, nil
+}
+
+// readDocuments reads all documents of input. A CSV input is one document.
+func (x *Proc) readDocuments(cfg *queryConfig) ([]interface{}, error) {
+	input := cfg.Input
 	var dataInput io.Reader = x.stdin
 	if input != "-" {
 		f, err := os.Open(filepath.Clean(input))
@@ -173,40 +699,175 @@ func (x *Proc) readData(input string, format string) (interface{}, error) {
 		}()
 	}
 
-	var results []interface{}
-	switch format {
-	case "json":
-		decoder := json.NewDecoder(dataInput)
-		for {
-			var doc interface{}
-			if err := decoder.Decode(&doc); err == io.EOF {
-				break
-			} else if err != nil {
+	var limit *sizeLimitReader
+	if cfg.MaxInputBytes > 0 {
+		limit = &sizeLimitReader{r: io.LimitReader(dataInput, cfg.MaxInputBytes+1), max: cfg.MaxInputBytes}
+		dataInput = limit
+	}
+
+	format := cfg.Format
+	if format == formatAuto {
+		format, dataInput = detectFormat(input, dataInput)
+		logger.With("format", format).Debug("detected input format")
+	}
+
+	results, err := decodeDocuments(cfg, format, dataInput)
+	// truncated input may cause decode error, then size error has priority
+	if limit != nil && limit.exceeded() {
+		return nil, goerr.Wrap(ErrInvalidInput, "input exceeds --max-input-bytes").
+			With("path", input).
+			With("max", cfg.MaxInputBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// decoded in order of options to support nested payload
+	for _, pointer := range cfg.DecodeBase64 {
+		keys, err := parseJSONPointer(pointer, "--decode-base64")
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range results {
+			if err := decodeBase64Field(doc, keys, pointer); err != nil {
 				return nil, goerr.Wrap(err).With("path", input)
 			}
-			results = append(results, doc)
 		}
+	}
+
+	if cfg.Single && len(results) != 1 {
+		return nil, goerr.Wrap(ErrInvalidInput, "exactly one document is required by --single").
+			With("path", input).
+			With("documents", len(results))
+	}
+
+	return results, nil
+}
+
+// sizeLimitReader counts bytes read from r to detect input larger than max. r should be limited to max+1 bytes by io.LimitReader to avoid reading whole of huge input.
+type sizeLimitReader struct {
+	r    io.Reader
+	read int64
+	max  int64
+}
+
+func (x *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	x.read += int64(n)
+	return n, err
+}
+
+func (x *sizeLimitReader) exceeded() bool {
+	return x.read > x.max
+}
+
+func decodeDocuments(cfg *queryConfig, format string, dataInput io.Reader) ([]interface{}, error) {
+	// CSV is not in decoder registry because it depends on --csv-no-header
+	if format == formatCSV {
+		// all rows are sent as one document
+		rows, err := decodeCSV(dataInput, cfg.CSVNoHeader)
+		if err != nil {
+			return nil, goerr.Wrap(err).With("path", cfg.Input)
+		}
+		return []interface{}{rows}, nil
+	}
+
+	decoder, ok := decoders[format]
+	if !ok {
+		return nil, goerr.Wrap(ErrInvalidConfiguration, "unsupported format").With("format", format)
+	}
+
+	results, err := decoder(dataInput)
+	if err != nil {
+		return nil, goerr.Wrap(err).With("path", cfg.Input).With("format", format)
+	}
+	return results, nil
+}
 
-	case "yaml":
-		decoder := yaml.NewDecoder(dataInput)
-		for {
-			var doc interface{}
-			if err := decoder.Decode(&doc); err == io.EOF {
-				break
-			} else if err != nil {
-				return nil, goerr.Wrap(err)
+func decodeJSONDocuments(r io.Reader) ([]interface{}, error) {
+	var results []interface{}
+	counter := &lineCounter{r: r}
+	decoder := json.NewDecoder(counter)
+	// keep precision of large integer in the same way as decodeJSON
+	decoder.UseNumber()
+	for {
+		var doc interface{}
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			offset := decoder.InputOffset()
+			var syntaxErr *json.SyntaxError
+			if errors.As(err, &syntaxErr) {
+				offset = syntaxErr.Offset - 1
+			} else if err == io.ErrUnexpectedEOF {
+				offset = counter.read
 			}
-			results = append(results, fixInterfaceMap(doc))
+			line, column := counter.position(offset)
+
+			return nil, goerr.Wrap(err).
+				With("offset", offset).
+				With("line", line).
+				With("column", column)
 		}
+		results = append(results, doc)
 	}
 
-	if len(results) == 1 {
-		return results[0], nil
+	return results, nil
+}
+
+func decodeTOMLDocuments(r io.Reader) ([]interface{}, error) {
+	var doc map[string]interface{}
+	if _, err := toml.NewDecoder(r).Decode(&doc); err != nil {
+		return nil, goerr.Wrap(err)
+	}
+	return []interface{}{doc}, nil
+}
+
+func decodeYAMLDocuments(r io.Reader) ([]interface{}, error) {
+	var results []interface{}
+	decoder := yaml.NewDecoder(r)
+	for {
+		var doc interface{}
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, goerr.Wrap(err)
+		}
+		results = append(results, fixInterfaceMap(doc))
 	}
 
 	return results, nil
 }
 
+// lineCounter records offsets of line breaks passing through to report position of decode error.
+type lineCounter struct {
+	r     io.Reader
+	read  int64
+	lines []int64
+}
+
+func (x *lineCounter) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] == '\n' {
+			x.lines = append(x.lines, x.read+int64(i))
+		}
+	}
+	x.read += int64(n)
+	return n, err
+}
+
+// position returns line and column (1-origin) of a byte at the offset.
+func (x *lineCounter) position(offset int64) (int, int) {
+	idx := sort.Search(len(x.lines), func(i int) bool {
+		return x.lines[i] >= offset
+	})
+	if idx == 0 {
+		return 1, int(offset + 1)
+	}
+	return idx + 1, int(offset - x.lines[idx-1])
+}
+
 func fixInterfaceMap(i interface{}) interface{} {
 	switch x := i.(type) {
 	case map[interface{}]interface{}:
@@ -223,7 +884,110 @@ func fixInterfaceMap(i interface{}) interface{} {
 	return i
 }
 
-func (x *Proc) writeData(output string, out interface{}) error {
+// writeMetrics writes server-side metrics to stderr to keep result output unchanged.
+func (x *Proc) writeMetrics(metrics QueryMetrics) error {
+	raw, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return goerr.Wrap(err)
+	}
+	if _, err := fmt.Fprintf(x.stderr, "server metrics:\n%s\n", string(raw)); err != nil {
+		return goerr.Wrap(err)
+	}
+	return nil
+}
+
+// writeTiming writes durations of HTTP request to stderr in the same way as writeMetrics.
+func (x *Proc) writeTiming(timing *requestTiming) error {
+	raw, err := json.MarshalIndent(timing.durations(), "", "  ")
+	if err != nil {
+		return goerr.Wrap(err)
+	}
+	if _, err := fmt.Fprintf(x.stderr, "http timing:\n%s\n", string(raw)); err != nil {
+		return goerr.Wrap(err)
+	}
+	return nil
+}
+
+// compareResult compares result with expected file. It writes diff to stderr and returns ErrExitWithNonZero if they are not matched.
+func (x *Proc) compareResult(path string, out interface{}) error {
+	format := formatByExt(path)
+	if format == "" {
+		format = formatJSON
+	}
+
+	expected, err := x.readData(&queryConfig{Input: path, Format: format})
+	if err != nil {
+		return err
+	}
+
+	expectedText, err := normalizeJSON(expected)
+	if err != nil {
+		return goerr.Wrap(err).With("path", path)
+	}
+	resultText, err := normalizeJSON(out)
+	if err != nil {
+		return goerr.Wrap(err)
+	}
+
+	diff := unifiedDiff(path, "result", expectedText, resultText)
+	if diff == "" {
+		logger.With("path", path).Debug("result matched with expected")
+		return nil
+	}
+
+	if _, err := io.WriteString(x.stderr, diff); err != nil {
+		return goerr.Wrap(err)
+	}
+	return ErrExitWithNonZero
+}
+
+// normalizeJSON converts v to indented JSON text in which number formats and key orders are normalized. Integers are compared exactly without conversion to float64.
+func normalizeJSON(v interface{}) (string, error) {
+	raw, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	var normalized interface{}
+	if err := decodeJSON(raw, &normalized); err != nil {
+		return "", err
+	}
+	text, err := json.MarshalIndent(normalizeNumber(normalized), "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(text) + "\n", nil
+}
+
+// normalizeNumber rewrites json.Number in v to a canonical form: integer (e.g. 1, 9007199254740993) is kept as it is, and other number (e.g. 1.0, 1e3) is formatted via float64.
+func normalizeNumber(v interface{}) interface{} {
+	switch x := v.(type) {
+	case json.Number:
+		if i, ok := new(big.Int).SetString(x.String(), 10); ok {
+			return json.Number(i.String())
+		}
+		f, err := x.Float64()
+		if err != nil {
+			return x
+		}
+		// integral float such as 1.0 and 1e3 is written as integer if it's exactly representable
+		if f == math.Trunc(f) && math.Abs(f) < 1<<53 {
+			return json.Number(strconv.FormatInt(int64(f), 10))
+		}
+		return f
+	case map[string]interface{}:
+		for k, e := range x {
+			x[k] = normalizeNumber(e)
+		}
+	case []interface{}:
+		for i, e := range x {
+			x[i] = normalizeNumber(e)
+		}
+	}
+	return v
+}
+
+func (x *Proc) writeData(cfg *queryConfig, out interface{}) error {
+	output := cfg.Output
 	var dataOutput io.Writer = x.stdout
 	if output != "-" {
 		f, err := os.Create(filepath.Clean(output))
@@ -238,14 +1002,43 @@ func (x *Proc) writeData(output string, out interface{}) error {
 		}()
 	}
 
+	// write raw result as it is without re-encoding. Terminate it by newline as encoder does
+	if raw, ok := out.(json.RawMessage); ok {
+		if _, err := dataOutput.Write(raw); err != nil {
+			return goerr.Wrap(err)
+		}
+		if !bytes.HasSuffix(raw, []byte("\n")) {
+			if _, err := dataOutput.Write([]byte("\n")); err != nil {
+				return goerr.Wrap(err)
+			}
+		}
+		return nil
+	}
+
 	encoder := json.NewEncoder(dataOutput)
 	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(!cfg.NoHTMLEscape)
 	if err := encoder.Encode(out); err != nil {
 		return goerr.Wrap(err)
 	}
 	return nil
 }
 
+// isEmptyInput returns true if input has no data: no document, null or empty object.
+// An empty array is NOT regarded as empty input because it is a valid document.
+func isEmptyInput(input interface{}) bool {
+	switch v := input.(type) {
+	case nil:
+		return true
+	case []interface{}:
+		return v == nil
+	case map[string]interface{}:
+		return len(v) == 0
+	}
+	return false
+}
+
+// isEmpty decides exit code of --fail-defined and --fail-undefined. Undefined result (no result field), null, empty object and empty array are empty. Any scalar value including false, 0 and "" is NOT empty.
 func isEmpty(out interface{}) bool {
 	if out == nil {
 		return true
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+)
+
+const (
+	outputFormatJSON  = "json"
+	outputFormatSARIF = "sarif"
+)
+
+// violationKeys are rule names of common violation shapes (Conftest and Gatekeeper style) and default SARIF level of each.
+var violationKeys = []struct {
+	name  string
+	level string
+}{
+	{name: "deny", level: "error"},
+	{name: "violation", level: "error"},
+	{name: "warn", level: "warning"},
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations,omitempty"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+	Region           *sarifRegion          `json:"region,omitempty"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+type sarifRegion struct {
+	StartLine int `json:"startLine"`
+}
+
+// toSARIF converts result into SARIF log. Violations are taken from deny, violation and warn fields of result object, or result itself if it's an array. A violation is a string message or an object with fields below.
+//   - msg or message: message text
+//   - id, rule or rule_id: rule ID, name of the field (e.g. deny) is used if not set
+//   - level or severity: SARIF level (error, warning, note and none) or severity (critical, high, medium, low and info)
+//   - file or path, and line: location. file or filename of --metadata is used if the violation has no file
+func toSARIF(out interface{}, metadata map[string]string) *sarifLog {
+	var results []sarifResult
+
+	switch v := out.(type) {
+	case []interface{}:
+		results = append(results, toSARIFResults(v, "violation", "error", metadata)...)
+	case map[string]interface{}:
+		for _, key := range violationKeys {
+			if list, ok := v[key.name].([]interface{}); ok {
+				results = append(results, toSARIFResults(list, key.name, key.level, metadata)...)
+			}
+		}
+	}
+
+	// results and rules must be an empty array instead of null for no violation
+	rules := []sarifRule{}
+	seen := map[string]bool{}
+	for _, result := range results {
+		if !seen[result.RuleID] {
+			seen[result.RuleID] = true
+			rules = append(rules, sarifRule{ID: result.RuleID})
+		}
+	}
+	if results == nil {
+		results = []sarifResult{}
+	}
+
+	return &sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs: []sarifRun{
+			{
+				Tool: sarifTool{
+					Driver: sarifDriver{
+						Name:           "opaq",
+						InformationURI: "https://github.com/m-mizutani/opaq",
+						Rules:          rules,
+					},
+				},
+				Results: results,
+			},
+		},
+	}
+}
+
+func toSARIFResults(violations []interface{}, ruleID, level string, metadata map[string]string) []sarifResult {
+	defaultURI := metadata["file"]
+	if defaultURI == "" {
+		defaultURI = metadata["filename"]
+	}
+
+	var results []sarifResult
+	for _, violation := range violations {
+		result := sarifResult{RuleID: ruleID, Level: level}
+		uri, line := defaultURI, 0
+
+		switch v := violation.(type) {
+		case string:
+			result.Message.Text = v
+		case map[string]interface{}:
+			result.Message.Text = firstString(v, "msg", "message")
+			if result.Message.Text == "" {
+				// keep whole violation as message rather than dropping it
+				raw, _ := json.Marshal(v)
+				result.Message.Text = string(raw)
+			}
+			if id := firstString(v, "id", "rule", "rule_id"); id != "" {
+				result.RuleID = id
+			}
+			if lv := sarifLevel(firstString(v, "level", "severity")); lv != "" {
+				result.Level = lv
+			}
+			if file := firstString(v, "file", "path"); file != "" {
+				uri = file
+			}
+			line = toInt(v["line"])
+		default:
+			raw, _ := json.Marshal(v)
+			result.Message.Text = string(raw)
+		}
+
+		if uri != "" {
+			loc := sarifLocation{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: uri},
+				},
+			}
+			if line > 0 {
+				loc.PhysicalLocation.Region = &sarifRegion{StartLine: line}
+			}
+			result.Locations = []sarifLocation{loc}
+		}
+
+		results = append(results, result)
+	}
+
+	return results
+}
+
+func firstString(obj map[string]interface{}, keys ...string) string {
+	for _, key := range keys {
+		if s, ok := obj[key].(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+// sarifLevel maps level or severity of violation to SARIF level. It returns empty string for unknown value.
+func sarifLevel(s string) string {
+	switch s {
+	case "error", "critical", "high":
+		return "error"
+	case "warning", "warn", "medium":
+		return "warning"
+	case "note", "low", "info":
+		return "note"
+	case "none":
+		return "none"
+	}
+	return ""
+}
+
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case json.Number:
+		i, _ := strconv.Atoi(n.String())
+		return i
+	case float64:
+		return int(n)
+	case string:
+		i, _ := strconv.Atoi(n)
+		return i
+	}
+	return 0
+}
+
+// formatOutput converts result for --output-format.
+func formatOutput(format string, out interface{}, metadata map[string]string) interface{} {
+	switch format {
+	case outputFormatSARIF:
+		return toSARIF(out, metadata)
+	default:
+		return out
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+)
+
+// requestTiming records timestamps of phases of a HTTP request by httptrace. DNS, connect and TLS are not recorded if an idle connection is reused.
+type requestTiming struct {
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	firstByte    time.Time
+	done         time.Time
+}
+
+// withTrace returns context to record timing of a request sent with it. start and done are set by caller.
+func (x *requestTiming) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			x.dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			x.dnsDone = time.Now()
+		},
+		ConnectStart: func(string, string) {
+			// keep first attempt if multiple addresses are tried
+			if x.connectStart.IsZero() {
+				x.connectStart = time.Now()
+			}
+		},
+		ConnectDone: func(string, string, error) {
+			x.connectDone = time.Now()
+		},
+		TLSHandshakeStart: func() {
+			x.tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			x.tlsDone = time.Now()
+		},
+		GotFirstResponseByte: func() {
+			x.firstByte = time.Now()
+		},
+	})
+}
+
+// durations returns duration of each recorded phase. first_byte and total are measured from start of the request.
+func (x *requestTiming) durations() map[string]string {
+	result := map[string]string{}
+	set := func(key string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			result[key] = to.Sub(from).String()
+		}
+	}
+
+	set("dns", x.dnsStart, x.dnsDone)
+	set("connect", x.connectStart, x.connectDone)
+	set("tls", x.tlsStart, x.tlsDone)
+	set("first_byte", x.start, x.firstByte)
+	set("total", x.start, x.done)
+
+	return result
+}